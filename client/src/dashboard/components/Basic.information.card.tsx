@@ -64,9 +64,7 @@ export function BasicInformationCard() {
                       <SelectValue />
                     </SelectTrigger>
                     <SelectContent position="popper">
-                      <SelectItem value="0" disabled>
-                        {t('BASIC.FORM.TYPES.0')}
-                      </SelectItem>
+                      <SelectItem value="0">{t('BASIC.FORM.TYPES.0')}</SelectItem>
                       <SelectItem value="1">{t('BASIC.FORM.TYPES.1')}</SelectItem>
                       <SelectItem value="2">{t('BASIC.FORM.TYPES.2')}</SelectItem>
                     </SelectContent>
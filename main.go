@@ -2,41 +2,45 @@ package main
 
 import (
 	"dana/simulator/server"
+	"flag"
+	"fmt"
 	"net/http"
-
-	"github.com/gorilla/websocket"
+	"time"
 )
 
-var upgrader = websocket.Upgrader{}
-
-var s = server.NewSimulator()
+var transport = flag.String("transport", "ble", "How the phone connects to the simulator: ble, tcp or ws")
+var tcpAddress = flag.String("tcp-address", ":3004", "Address to listen on for BLE relays when using the tcp transport")
+var speed = flag.Float64("speed", 1, "How much faster than real time the pump runs, e.g. 60 runs an hour in a minute")
 
 func main() {
-	s.StartBluetooth()
-	// http.HandleFunc("/ws", handleWS)
+	flag.Parse()
+
+	s, err := server.NewSimulator()
+	if err != nil {
+		panic(fmt.Sprintf("failed to load the pump: %s", err))
+	}
+
+	if *speed != 1 {
+		s.SetClock(server.NewAcceleratedClock(time.Now(), *speed))
+	}
+
+	switch *transport {
+	case "ble":
+		s.StartBluetooth()
+	case "tcp":
+		s.Start(server.NewTcpTransport(*tcpAddress))
+	case "ws":
+		var webSocketTransport = server.NewWebSocketTransport()
+		http.Handle("/ws", webSocketTransport)
+		s.Start(webSocketTransport)
+	default:
+		panic(fmt.Sprintf("unknown transport: %s", *transport))
+	}
+
+	http.Handle("/api/", server.NewControlPlane(&s))
 	http.ListenAndServe(":3003", nil)
 }
 
-// func handleWS(w http.ResponseWriter, r *http.Request) {
-// 	// Upgrade upgrades the HTTP server connection to the WebSocket protocol.
-// 	conn, err := upgrader.Upgrade(w, r, nil)
-// 	if err != nil {
-// 		log.Print("upgrade failed: ", err)
-// 		return
-// 	}
-// 	defer conn.Close()
-
-// 	// Continuosly read and write message
-// 	for {
-// 		mt, message, err := conn.ReadMessage()
-// 		if err != nil {
-// 			log.Println("read failed:", err)
-// 			break
-// 		}
-// 		input := string(message)
-// 	}
-// }
-
 // func startPump() {
 // 	if s.State.Status == server.STATUS_RUNNING {
 // 		return
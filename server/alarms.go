@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Alarm codes, as send in the OPCODE_NOTIFY__ALARM notification
+const (
+	ALARM_CODE_NONE            byte = 0x00
+	ALARM_CODE_BATTERY_EMPTY   byte = 0x01
+	ALARM_CODE_PUMP_ERROR      byte = 0x02
+	ALARM_CODE_OCCLUSION       byte = 0x03
+	ALARM_CODE_LOW_BATTERY     byte = 0x04
+	ALARM_CODE_SHUTDOWN        byte = 0x05
+	ALARM_CODE_BASAL_COMPARE   byte = 0x06
+	ALARM_CODE_LOW_RESERVOIR   byte = 0x08
+	ALARM_CODE_EMPTY_RESERVOIR byte = 0x09
+	ALARM_CODE_CHECK_SHAFT     byte = 0x0a
+	ALARM_CODE_BASAL_MAX       byte = 0x0b
+	ALARM_CODE_DAILY_MAX       byte = 0x0c
+)
+
+// Error state of the Dana-I, reported in the initial screen information. Only one state is reported at a time
+const (
+	ERROR_STATE_NONE             byte = 0x00
+	ERROR_STATE_SUSPENDED        byte = 0x01
+	ERROR_STATE_DAILY_MAX        byte = 0x02
+	ERROR_STATE_BOLUS_BLOCK      byte = 0x04
+	ERROR_STATE_ORDER_DELIVERING byte = 0x08
+	ERROR_STATE_NO_PRIME         byte = 0x10
+)
+
+type Alarm struct {
+	Name string
+	// Character which is stored in Param8 of the alarm history item. Every alarm has its own character, so the phone
+	// can tell a low battery ('B') from an empty battery ('X'). AAPS only knows P, R, C, O, M, D, B & S, the battery
+	// empty ('X'), pump error ('E') & low reservoir ('L') characters are simulator-only and show up as unknown alarms
+	HistoryCode byte
+	// A blocking alarm stops all delivery, till the alarm is cleared on the pump
+	IsBlocking bool
+}
+
+var Alarms = map[byte]Alarm{
+	ALARM_CODE_BATTERY_EMPTY:   {Name: "battery-empty", HistoryCode: 'X', IsBlocking: true},
+	ALARM_CODE_PUMP_ERROR:      {Name: "pump-error", HistoryCode: 'E', IsBlocking: true},
+	ALARM_CODE_OCCLUSION:       {Name: "occlusion", HistoryCode: 'O', IsBlocking: true},
+	ALARM_CODE_LOW_BATTERY:     {Name: "low-battery", HistoryCode: 'B', IsBlocking: false},
+	ALARM_CODE_SHUTDOWN:        {Name: "shutdown", HistoryCode: 'S', IsBlocking: true},
+	ALARM_CODE_BASAL_COMPARE:   {Name: "basal-compare", HistoryCode: 'P', IsBlocking: false},
+	ALARM_CODE_LOW_RESERVOIR:   {Name: "low-reservoir", HistoryCode: 'L', IsBlocking: false},
+	ALARM_CODE_EMPTY_RESERVOIR: {Name: "empty-reservoir", HistoryCode: 'R', IsBlocking: true},
+	ALARM_CODE_CHECK_SHAFT:     {Name: "check-shaft", HistoryCode: 'C', IsBlocking: true},
+	ALARM_CODE_BASAL_MAX:       {Name: "basal-max", HistoryCode: 'M', IsBlocking: false},
+	ALARM_CODE_DAILY_MAX:       {Name: "daily-max", HistoryCode: 'D', IsBlocking: false},
+}
+
+// FindAlarm looks up the alarm code by the name of the alarm
+func FindAlarm(name string) (byte, bool) {
+	for code, alarm := range Alarms {
+		if alarm.Name == name {
+			return code, true
+		}
+	}
+
+	return ALARM_CODE_NONE, false
+}
+
+// raiseAlarm notifies the phone about the alarm & stores it in the history. Running deliveries notice a blocking
+// alarm on their next tick
+func (c *CommandCenter) raiseAlarm(code byte) {
+	var alarm = Alarms[code]
+	fmt.Println(time.Now().Format(time.RFC3339) + " WARNING: Raising alarm: " + alarm.Name)
+
+	if alarm.IsBlocking {
+		c.state.ActiveAlarm = code
+	}
+
+	c.state.History = append(c.state.History, HistoryItem{
+		Timestamp: c.clock.Now(),
+		Code:      HISTORY_ALARM,
+		Param8:    alarm.HistoryCode,
+	})
+	c.state.Save()
+
+	c.encodeAndNotify(OPCODE_NOTIFY__ALARM, []byte{code})
+}
+
+// clearAlarm confirms the active alarm, like the user would on the pump itself
+func (c *CommandCenter) clearAlarm() {
+	if c.state.ActiveAlarm == ALARM_CODE_NONE {
+		return
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Clearing alarm: " + Alarms[c.state.ActiveAlarm].Name)
+
+	var now = c.clock.Now()
+	c.state.ActiveAlarm = ALARM_CODE_NONE
+	c.state.LastInteractionAt = &now
+	c.state.Save()
+}
+
+// isDeliveryBlocked returns true while a blocking alarm hasnt been cleared, while the battery is empty or while the
+// pump hasnt been primed after a refill
+func (c *CommandCenter) isDeliveryBlocked() bool {
+	return c.state.ActiveAlarm != ALARM_CODE_NONE || c.state.BatteryCharge <= 0 || c.state.IsPrimeRequired
+}
+
+// checkShutdown raises the shutdown alarm when the pump hasnt been used for ShutdownInHours (0 disables the shutdown)
+func (c *CommandCenter) checkShutdown() {
+	var now = c.clock.Now()
+	if c.state.LastInteractionAt == nil {
+		c.state.LastInteractionAt = &now
+		return
+	}
+
+	if c.state.ShutdownInHours <= 0 || c.isDeliveryBlocked() {
+		return
+	}
+
+	if now.Sub(*c.state.LastInteractionAt) >= time.Duration(c.state.ShutdownInHours)*time.Hour {
+		c.raiseAlarm(ALARM_CODE_SHUTDOWN)
+	}
+}
+
+// errorState returns the error state of the Dana-I. The phone reads it as a single state, not as flags, so only the
+// most important one is reported
+func (c *CommandCenter) errorState() byte {
+	switch {
+	case c.state.IsPrimeRequired:
+		return ERROR_STATE_NO_PRIME
+	case c.isDeliveryBlocked():
+		return ERROR_STATE_BOLUS_BLOCK
+	case c.state.IsSuspended:
+		return ERROR_STATE_SUSPENDED
+	case c.state.TodayBasalDelivered+c.state.TodayBolusDelivered >= float32(c.state.MaxDailyTotal):
+		return ERROR_STATE_DAILY_MAX
+	case c.bolusTicker != nil:
+		return ERROR_STATE_ORDER_DELIVERING
+	default:
+		return ERROR_STATE_NONE
+	}
+}
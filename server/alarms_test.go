@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestAlarmWithoutPhone(t *testing.T) {
+	useTempWorkingDirectory(t)
+
+	var state = NewState()
+	state.PumpType = PUMP_TYPE_DANA_RS_V3
+
+	var simulator = NewSimulatorWithState(state)
+	simulator.SetClock(NewFixedClock(testStartTime))
+
+	var transport = NewLoopbackTransport()
+	simulator.Start(transport)
+
+	// Listening on the link, without a handshake
+	var frames = 0
+	transport.Connect(func(data []byte) { frames++ })
+
+	simulator.RaiseAlarm(ALARM_CODE_LOW_BATTERY)
+	if frames != 0 {
+		t.Fatalf("expected no notification without a phone, got %d frames", frames)
+	}
+
+	var client = NewClient(transport, simulator.State.Name, PUMP_TYPE_DANA_RS_V3)
+	client.Timeout = time.Second
+	client.PairingKeys = simulator.State.PairingKeys
+	client.RandomPairingKeys = simulator.State.RandomPairingKeys
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	simulator.RaiseAlarm(ALARM_CODE_OCCLUSION)
+	var data, err = client.WaitForNotification(OPCODE_NOTIFY__ALARM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{ALARM_CODE_OCCLUSION}) {
+		t.Errorf("expected alarm %v, got %v", []byte{ALARM_CODE_OCCLUSION}, data)
+	}
+
+	// Both alarms are in the history
+	var alarms = 0
+	for _, item := range simulator.State.History {
+		if item.Code == HISTORY_ALARM {
+			alarms++
+		}
+	}
+	if alarms != 2 {
+		t.Errorf("expected 2 alarms in the history, got %d", alarms)
+	}
+}
+
+func TestErrorState(t *testing.T) {
+	var tests = []struct {
+		name     string
+		setup    func(state *SimulatorState)
+		expected byte
+	}{
+		{"none", func(state *SimulatorState) {}, ERROR_STATE_NONE},
+		{"suspended", func(state *SimulatorState) { state.IsSuspended = true }, ERROR_STATE_SUSPENDED},
+		{"daily max", func(state *SimulatorState) { state.TodayBolusDelivered = 250 }, ERROR_STATE_DAILY_MAX},
+		{"blocking alarm", func(state *SimulatorState) { state.ActiveAlarm = ALARM_CODE_OCCLUSION }, ERROR_STATE_BOLUS_BLOCK},
+		{"empty battery", func(state *SimulatorState) { state.BatteryCharge = 0 }, ERROR_STATE_BOLUS_BLOCK},
+		{"suspended with a blocking alarm", func(state *SimulatorState) {
+			state.IsSuspended = true
+			state.ActiveAlarm = ALARM_CODE_OCCLUSION
+		}, ERROR_STATE_BOLUS_BLOCK},
+		{"suspended at the daily max", func(state *SimulatorState) {
+			state.IsSuspended = true
+			state.TodayBolusDelivered = 250
+		}, ERROR_STATE_SUSPENDED},
+		{"prime required with a blocking alarm", func(state *SimulatorState) {
+			state.IsPrimeRequired = true
+			state.ActiveAlarm = ALARM_CODE_OCCLUSION
+		}, ERROR_STATE_NO_PRIME},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state = NewState()
+			test.setup(&state)
+
+			var _, client, _ = startLoopbackWithState(t, state)
+			var response, err = client.Command(OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, []byte{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(response) != 16 || response[15] != test.expected {
+				t.Errorf("expected error state %#x, got %v", test.expected, response)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// Default drain of the battery (in % of the charge), a fresh battery lasts about 3 to 4 weeks
+	BATTERY_DRAIN_PER_DAY     float32 = 4
+	BATTERY_DRAIN_PER_COMMAND float32 = 0.002
+	BATTERY_DRAIN_PER_UNIT    float32 = 0.01
+
+	// Below this charge the pump raises the low battery alarm
+	BATTERY_LOW_CHARGE float32 = 20
+)
+
+// drainBattery drains the charge of the battery, raising the low battery alarm & the battery empty alarm on the way
+func (c *CommandCenter) drainBattery(drain float32) {
+	if drain <= 0 || c.state.BatteryCharge <= 0 {
+		return
+	}
+
+	var wasAboveLow = c.state.BatteryCharge >= BATTERY_LOW_CHARGE
+	c.state.BatteryCharge = max(c.state.BatteryCharge-drain, 0)
+	c.state.BatteryRemaining = batteryRemaining(c.state.BatteryCharge)
+
+	if wasAboveLow && c.state.BatteryCharge < BATTERY_LOW_CHARGE && c.state.BatteryCharge > 0 {
+		c.raiseAlarm(ALARM_CODE_LOW_BATTERY)
+	}
+	if c.state.BatteryCharge <= 0 {
+		c.raiseAlarm(ALARM_CODE_BATTERY_EMPTY)
+	}
+}
+
+// replaceBattery puts in a fresh battery, which clears the battery empty alarm as well
+func (c *CommandCenter) replaceBattery() {
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Replacing battery")
+
+	c.state.BatteryCharge = 100
+	c.state.BatteryRemaining = batteryRemaining(c.state.BatteryCharge)
+	if c.state.ActiveAlarm == ALARM_CODE_BATTERY_EMPTY {
+		c.clearAlarm()
+	}
+	c.state.Save()
+}
+
+// batteryRemaining rounds the charge up to the steps of 25% the pump reports, only an empty battery reports 0%
+func batteryRemaining(charge float32) int {
+	return int(math.Ceil(float64(charge)/25)) * 25
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBatteryRemaining(t *testing.T) {
+	var tests = []struct {
+		charge   float32
+		expected int
+	}{
+		{100, 100},
+		{99.9, 100},
+		{75, 75},
+		{50.1, 75},
+		{20, 25},
+		{0.1, 25},
+		{0, 0},
+	}
+
+	for _, test := range tests {
+		if remaining := batteryRemaining(test.charge); remaining != test.expected {
+			t.Errorf("expected %d%% for a charge of %v%%, got %d%%", test.expected, test.charge, remaining)
+		}
+	}
+}
+
+func TestBatteryDrain(t *testing.T) {
+	var tests = []struct {
+		name     string
+		charge   float32
+		alarm    byte
+		isActive bool
+		// The initial screen, with the battery at byte 10 & the error state at byte 15
+		expected []byte
+	}{
+		{"low", 20.5, ALARM_CODE_LOW_BATTERY, false, []byte{0x00, 0x00, 0x00, 0xa8, 0x61, 0x30, 0x75, 0x00, 0x00, 0x64, 0x19, 0x00, 0x00, 0x00, 0x00, ERROR_STATE_NONE}},
+		{"empty", 0.5, ALARM_CODE_BATTERY_EMPTY, true, []byte{0x00, 0x00, 0x00, 0xa8, 0x61, 0x30, 0x75, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00, ERROR_STATE_BOLUS_BLOCK}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state = NewState()
+			state.BasalProfiles[state.ActiveBasalProfile] = make([]float32, BASAL_SLOTS_PER_PROFILE)
+			state.BatteryCharge = test.charge
+			state.BatteryRemaining = batteryRemaining(test.charge)
+
+			var simulator, client, clock = startLoopbackWithState(t, state)
+
+			// A day drains 4%
+			clock.Advance(6 * time.Hour)
+
+			var data, err = client.WaitForNotification(OPCODE_NOTIFY__ALARM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, []byte{test.alarm}) {
+				t.Errorf("expected alarm %v, got %v", []byte{test.alarm}, data)
+			}
+
+			response, err := client.Command(OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, []byte{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(response, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, response)
+			}
+
+			// Only the blocking alarm has to be cleared
+			if isActive := simulator.State.ActiveAlarm == test.alarm; isActive != test.isActive {
+				t.Errorf("expected alarm %d to be active: %v, got alarm %d", test.alarm, test.isActive, simulator.State.ActiveAlarm)
+			}
+		})
+	}
+}
+
+func TestReplaceBattery(t *testing.T) {
+	var state = NewState()
+	state.BatteryCharge = 0
+	state.BatteryRemaining = 0
+	state.ActiveAlarm = ALARM_CODE_BATTERY_EMPTY
+
+	var simulator, _, _ = startLoopbackWithState(t, state)
+	simulator.ReplaceBattery()
+
+	if simulator.State.BatteryCharge != 100 || simulator.State.BatteryRemaining != 100 {
+		t.Errorf("expected a full battery, got a charge of %v%% reported as %d%%", simulator.State.BatteryCharge, simulator.State.BatteryRemaining)
+	}
+	if simulator.State.ActiveAlarm != ALARM_CODE_NONE {
+		t.Errorf("expected the battery empty alarm to be cleared, got alarm %d", simulator.State.ActiveAlarm)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// BluetoothTransport advertises the simulator as a real BLE peripheral using the TinyGo bluetooth stack (BlueZ on linux)
+type BluetoothTransport struct {
+	adapter *bluetooth.Adapter
+
+	writeCharacteristic bluetooth.Characteristic
+	readCharacteristic  bluetooth.Characteristic
+}
+
+func NewBluetoothTransport() *BluetoothTransport {
+	return &BluetoothTransport{
+		adapter: bluetooth.DefaultAdapter,
+	}
+}
+
+func (t *BluetoothTransport) Start(name string, onReceive func(data []byte)) error {
+	setDeviceName(name)
+
+	// TinyGo bluetooth (linux) doesnt support connection handler
+	// adapter.SetConnectHandler(func(device bluetooth.Device, connected bool) {
+	// 	if connected && s.hasOpenConnection {
+	// 		fmt.Println("ERROR: Rejecting connection from " + device.Address.String() + ", Already has an open connection")
+	// 	} else if connected {
+	// 		s.hasOpenConnection = true
+	// 		s.isConnectionSecure = false
+	// 		encryption.ResetRandomSyncKey()
+	// 		s.readBuffer = []byte{}
+	// 		fmt.Println("INFO: Device connected: " + device.Address.String())
+	// 	} else {
+	// 		s.hasOpenConnection = false
+	// 		fmt.Println("INFO: Device disconnected: " + device.Address.String())
+	// 	}
+	// })
+
+	if err := t.adapter.Enable(); err != nil {
+		return fmt.Errorf("failed to enable BLE stack: %w", err)
+	}
+
+	// Define the peripheral device info.
+	adv := t.adapter.DefaultAdvertisement()
+	if err := adv.Configure(bluetooth.AdvertisementOptions{
+		LocalName:    name,
+		ServiceUUIDs: []bluetooth.UUID{},
+	}); err != nil {
+		return fmt.Errorf("failed to config adv: %w", err)
+	}
+
+	// Start advertising
+	if err := adv.Start(); err != nil {
+		return fmt.Errorf("failed to start adv: %w", err)
+	}
+	fmt.Println("Adversing with name: " + name)
+
+	return t.adapter.AddService(&bluetooth.Service{
+		UUID: bluetooth.New16BitUUID(0xFFF0),
+		Characteristics: []bluetooth.CharacteristicConfig{
+			{
+				Handle: &t.writeCharacteristic,
+				UUID:   bluetooth.New16BitUUID(0xFFF1),
+				Value:  []byte{},
+				Flags:  bluetooth.CharacteristicNotifyPermission,
+			},
+			{
+				Handle: &t.readCharacteristic,
+				UUID:   bluetooth.New16BitUUID(0xFFF2),
+				Value:  []byte{},
+				Flags:  bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
+				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					onReceive(value)
+				},
+			},
+		},
+	})
+}
+
+func (t *BluetoothTransport) Write(data []byte) error {
+	var _, err = t.writeCharacteristic.Write(data)
+	return err
+}
+
+func setDeviceName(name string) {
+	// Force bluetooth name. This only works on linux
+	must("Write new machine-info file", os.WriteFile("machine-info", []byte("PRETTY_HOSTNAME="+name), 0666))
+
+	var cmd = exec.Command("/bin/sh", "-c", "sudo mv machine-info /etc/machine-info")
+	must("Write bluetooth name", cmd.Run())
+
+	// Randomize MAC-address to prevent device name caching issues, based on device name
+	// https://raspberrypi.stackexchange.com/a/124117
+	var newMac = ""
+	for i := 0; i < 6; i++ {
+		newMac += fmt.Sprintf("0x%x ", name[i])
+	}
+
+	fmt.Println("New BLE mac address (reversed): " + newMac)
+	cmd = exec.Command("/bin/sh", "-c", "sudo hcitool cmd 0x3f 0x001 "+newMac)
+	must("Randomize MAC-address", cmd.Run())
+
+	cmd = exec.Command("/bin/sh", "-c", "sudo hciconfig hci0 reset")
+	must("Reset bluetooth driver", cmd.Run())
+
+	cmd = exec.Command("/bin/sh", "-c", "sudo service bluetooth restart")
+	must("Restart bluetooth chip", cmd.Run())
+
+	time.Sleep(5 * time.Second)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// The pump divides the day into 4 blocks for the bolus calculator: morning (6-11), afternoon (11-17), evening
+	// (17-22) & night (22-6). The Dana-I uses a value for every hour instead
+	CIR_CF_BLOCK_COUNT = 4
+	CIR_CF_HOUR_COUNT  = 24
+
+	// The 4 blocks are send in 7 slots, of which only the even ones are used
+	CIR_CF_SLOT_COUNT = 7
+
+	DEFAULT_CARB_RATIO        = 10
+	DEFAULT_CORRECTION_FACTOR = 36
+	DEFAULT_TARGET_BG         = 90
+
+	MMOL_TO_MGDL = 18.0182
+)
+
+// repeatValue returns count times the value, used for the defaults of the bolus calculator
+func repeatValue(value float32, count int) []float32 {
+	var values = make([]float32, count)
+	for i := range values {
+		values[i] = value
+	}
+
+	return values
+}
+
+// cirCfBlock returns the block of the bolus calculator the time falls in
+func cirCfBlock(t time.Time) int {
+	switch {
+	case t.Hour() >= 6 && t.Hour() < 11:
+		return 0
+	case t.Hour() >= 11 && t.Hour() < 17:
+		return 1
+	case t.Hour() >= 17 && t.Hour() < 22:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// currentCirCf returns the carb ratio & correction factor (in mg/dL) which apply right now
+func (c *CommandCenter) currentCirCf() (float32, float32) {
+	var now = c.clock.Now()
+	if c.state.PumpType == PUMP_TYPE_DANA_I {
+		return c.state.HourlyCarbRatios[now.Hour()], c.state.HourlyCorrectionFactors[now.Hour()]
+	}
+
+	var block = cirCfBlock(now)
+	return c.state.CarbRatios[block], c.state.CorrectionFactors[block]
+}
+
+// encodeGlucose encodes a glucose value (in mg/dL) in the units of the pump, mmol/L is send times 100
+func (c *CommandCenter) encodeGlucose(value float32) int {
+	if c.state.Units == UNITS_MMOL {
+		return int(math.Round(float64(value) / MMOL_TO_MGDL * 100))
+	}
+
+	return int(math.Round(float64(value)))
+}
+
+func (c *CommandCenter) decodeGlucose(value int) float32 {
+	if c.state.Units == UNITS_MMOL {
+		return float32(float64(value) / 100 * MMOL_TO_MGDL)
+	}
+
+	return float32(value)
+}
+
+func (c *CommandCenter) respondToGetCirCfArray() {
+	var message = []byte{byte(c.state.SelectedLanguage), byte(c.state.Units)}
+
+	for slot := 0; slot < CIR_CF_SLOT_COUNT; slot++ {
+		var carbRatio = 0
+		if slot%2 == 0 {
+			carbRatio = int(c.state.CarbRatios[slot/2])
+		}
+		message = append(message, byte(carbRatio), byte(carbRatio>>8))
+	}
+	for slot := 0; slot < CIR_CF_SLOT_COUNT; slot++ {
+		var correctionFactor = 0
+		if slot%2 == 0 {
+			correctionFactor = c.encodeGlucose(c.state.CorrectionFactors[slot/2])
+		}
+		message = append(message, byte(correctionFactor), byte(correctionFactor>>8))
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__GET_CIR_CF_ARRAY - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BOLUS__GET_CIR_CF_ARRAY, message)
+}
+
+func (c *CommandCenter) respondToSetCirCfArray(request []byte) {
+	if len(request) < 2+CIR_CF_SLOT_COUNT*2*2 {
+		c.rejectCirCf(OPCODE_BOLUS__SET_CIR_CF_ARRAY, "request too short")
+		return
+	}
+
+	var values = request[2:]
+	var carbRatios = make([]float32, CIR_CF_BLOCK_COUNT)
+	var correctionFactors = make([]float32, CIR_CF_BLOCK_COUNT)
+	for block := range carbRatios {
+		var slot = block * 2
+		carbRatios[block] = float32(int(values[slot*2]) | int(values[slot*2+1])<<8)
+		correctionFactors[block] = c.decodeGlucose(int(values[(CIR_CF_SLOT_COUNT+slot)*2]) | int(values[(CIR_CF_SLOT_COUNT+slot)*2+1])<<8)
+	}
+
+	if !c.checkCirCf(OPCODE_BOLUS__SET_CIR_CF_ARRAY, carbRatios, correctionFactors) {
+		return
+	}
+
+	c.state.CarbRatios = carbRatios
+	c.state.CorrectionFactors = correctionFactors
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_CIR_CF_ARRAY - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE_BOLUS__SET_CIR_CF_ARRAY, []byte{0x00})
+}
+
+func (c *CommandCenter) respondToGet24CirCfArray() {
+	var message = []byte{byte(c.state.Units)}
+
+	for _, carbRatio := range c.state.HourlyCarbRatios {
+		message = append(message, byte(int(carbRatio)), byte(int(carbRatio)>>8))
+	}
+	for _, correctionFactor := range c.state.HourlyCorrectionFactors {
+		var value = c.encodeGlucose(correctionFactor)
+		message = append(message, byte(value), byte(value>>8))
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__GET_24_CIR_CF_ARRAY - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BOLUS__GET_24_CIR_CF_ARRAY, message)
+}
+
+func (c *CommandCenter) respondToSet24CirCfArray(request []byte) {
+	if len(request) < 2+CIR_CF_HOUR_COUNT*2*2 {
+		c.rejectCirCf(OPCODE_BOLUS__SET_24_CIR_CF_ARRAY, "request too short")
+		return
+	}
+
+	var values = request[2:]
+	var carbRatios = make([]float32, CIR_CF_HOUR_COUNT)
+	var correctionFactors = make([]float32, CIR_CF_HOUR_COUNT)
+	for hour := range carbRatios {
+		carbRatios[hour] = float32(int(values[hour*2]) | int(values[hour*2+1])<<8)
+		correctionFactors[hour] = c.decodeGlucose(int(values[(CIR_CF_HOUR_COUNT+hour)*2]) | int(values[(CIR_CF_HOUR_COUNT+hour)*2+1])<<8)
+	}
+
+	if !c.checkCirCf(OPCODE_BOLUS__SET_24_CIR_CF_ARRAY, carbRatios, correctionFactors) {
+		return
+	}
+
+	c.state.HourlyCarbRatios = carbRatios
+	c.state.HourlyCorrectionFactors = correctionFactors
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_24_CIR_CF_ARRAY - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE_BOLUS__SET_24_CIR_CF_ARRAY, []byte{0x00})
+}
+
+// checkCirCf rejects the command when a carb ratio or correction factor is 0, the pump would divide by it
+func (c *CommandCenter) checkCirCf(code byte, carbRatios []float32, correctionFactors []float32) bool {
+	for i := range carbRatios {
+		if carbRatios[i] <= 0 || correctionFactors[i] <= 0 {
+			c.rejectCirCf(code, "carb ratio & correction factor must be above 0, index: "+fmt.Sprint(i))
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *CommandCenter) rejectCirCf(code byte, reason string) {
+	fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting CIR/CF, " + reason + " - Data: " + base64.StdEncoding.EncodeToString([]byte{ERROR_CODE_COMMAND}))
+	c.encodeAndWrite(code, []byte{ERROR_CODE_COMMAND})
+}
+
+// lastHistoryValue returns the value of the last history item with the code, like the last glucose measurement
+func (c *CommandCenter) lastHistoryValue(code byte) int {
+	for i := len(c.state.History) - 1; i >= 0; i-- {
+		if c.state.History[i].Code == code {
+			return int(c.state.History[i].Value)
+		}
+	}
+
+	return 0
+}
+
+// respondToCalculationInformation sends the input of the bolus calculator: the last glucose & carbs, the target, the
+// current carb ratio & correction factor and the insulin on board. Glucose values are in the units of the pump
+func (c *CommandCenter) respondToCalculationInformation() {
+	var carbRatio, correctionFactor = c.currentCirCf()
+
+	var currentBg = c.lastHistoryValue(HISTORY_GLUCOSE)
+	var carbohydrate = c.lastHistoryValue(HISTORY_CARBO)
+	var target = c.encodeGlucose(c.state.TargetBg)
+	var cir = int(carbRatio)
+	var cf = c.encodeGlucose(correctionFactor)
+	var insulinOnBoard = int(c.insulinOnBoard() * 100)
+
+	var message = []byte{
+		0x00,
+		byte(currentBg), byte(currentBg >> 8),
+		byte(carbohydrate), byte(carbohydrate >> 8),
+		byte(target), byte(target >> 8),
+		byte(cir), byte(cir >> 8),
+		byte(cf), byte(cf >> 8),
+		byte(insulinOnBoard), byte(insulinOnBoard >> 8),
+		byte(c.state.Units),
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__GET_CALCULATION_INFORMATION - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BOLUS__GET_CALCULATION_INFORMATION, message)
+}
+
+func (c *CommandCenter) respondToCarbohydrateCalculationInformation() {
+	var carbRatio, _ = c.currentCirCf()
+
+	var carbohydrate = c.lastHistoryValue(HISTORY_CARBO)
+	var cir = int(carbRatio)
+
+	var message = []byte{
+		0x00,
+		byte(carbohydrate), byte(carbohydrate >> 8),
+		byte(cir), byte(cir >> 8),
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__GET_CARBOHYDRATE_CALCULATION_INFORMATION - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BOLUS__GET_CARBOHYDRATE_CALCULATION_INFORMATION, message)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// cirCfSlots encodes the 4 blocks in the 7 slots of the CIR/CF array, in which only the even slots are used
+func cirCfSlots(blocks ...[]byte) []byte {
+	var slots = []byte{}
+	for i, block := range blocks {
+		if i > 0 {
+			slots = append(slots, 0x00, 0x00)
+		}
+		slots = append(slots, block...)
+	}
+
+	return slots
+}
+
+func TestCirCfArray(t *testing.T) {
+	var _, client, _ = startLoopback(t, PUMP_TYPE_DANA_RS_V3)
+
+	// A carb ratio of 10 & a correction factor of 36 mg/dL (2.00 mmol/L) for every block
+	var defaultCarbRatios = cirCfSlots([]byte{0x0a, 0x00}, []byte{0x0a, 0x00}, []byte{0x0a, 0x00}, []byte{0x0a, 0x00})
+	var defaultCorrectionFactors = cirCfSlots([]byte{0xc8, 0x00}, []byte{0xc8, 0x00}, []byte{0xc8, 0x00}, []byte{0xc8, 0x00})
+
+	// Carb ratios of 8, 12, 15 & 20 and correction factors of 2.50, 2.00, 3.00 & 1.80 mmol/L
+	var carbRatios = cirCfSlots([]byte{0x08, 0x00}, []byte{0x0c, 0x00}, []byte{0x0f, 0x00}, []byte{0x14, 0x00})
+	var correctionFactors = cirCfSlots([]byte{0xfa, 0x00}, []byte{0xc8, 0x00}, []byte{0x2c, 0x01}, []byte{0xb4, 0x00})
+	var withoutCarbRatio = cirCfSlots([]byte{0x08, 0x00}, []byte{0x00, 0x00}, []byte{0x0f, 0x00}, []byte{0x14, 0x00})
+
+	// Language & units (mmol/L), followed by the carb ratios & the correction factors (times 100 in mmol/L)
+	var header = []byte{0x01, UNITS_MMOL}
+
+	runCommandTests(t, client, []commandTest{
+		{"defaults", OPCODE_BOLUS__GET_CIR_CF_ARRAY, []byte{}, slices.Concat(header, defaultCarbRatios, defaultCorrectionFactors)},
+		{"set", OPCODE_BOLUS__SET_CIR_CF_ARRAY, slices.Concat(carbRatios, correctionFactors), []byte{0x00}},
+		{"get", OPCODE_BOLUS__GET_CIR_CF_ARRAY, []byte{}, slices.Concat(header, carbRatios, correctionFactors)},
+		{"set without a carb ratio", OPCODE_BOLUS__SET_CIR_CF_ARRAY, slices.Concat(withoutCarbRatio, correctionFactors), []byte{ERROR_CODE_COMMAND}},
+		{"set too short", OPCODE_BOLUS__SET_CIR_CF_ARRAY, carbRatios, []byte{ERROR_CODE_COMMAND}},
+		{"unchanged", OPCODE_BOLUS__GET_CIR_CF_ARRAY, []byte{}, slices.Concat(header, carbRatios, correctionFactors)},
+	})
+}
+
+func Test24CirCfArray(t *testing.T) {
+	var _, client, _ = startLoopback(t, PUMP_TYPE_DANA_I)
+
+	// A carb ratio of 10 & a correction factor of 2.00 mmol/L for every hour
+	var defaultCarbRatios = hourlyRates([]byte{0x0a, 0x00}, []byte{0x0a, 0x00})
+	var defaultCorrectionFactors = hourlyRates([]byte{0xc8, 0x00}, []byte{0xc8, 0x00})
+
+	// A carb ratio of 10 in the first half of the day & 12 in the second half, with a correction factor of 3.00 mmol/L
+	var carbRatios = hourlyRates([]byte{0x0a, 0x00}, []byte{0x0c, 0x00})
+	var correctionFactors = hourlyRates([]byte{0x2c, 0x01}, []byte{0x2c, 0x01})
+
+	runCommandTests(t, client, []commandTest{
+		{"defaults", OPCODE_BOLUS__GET_24_CIR_CF_ARRAY, []byte{}, slices.Concat([]byte{UNITS_MMOL}, defaultCarbRatios, defaultCorrectionFactors)},
+		{"set", OPCODE_BOLUS__SET_24_CIR_CF_ARRAY, slices.Concat(carbRatios, correctionFactors), []byte{0x00}},
+		{"get", OPCODE_BOLUS__GET_24_CIR_CF_ARRAY, []byte{}, slices.Concat([]byte{UNITS_MMOL}, carbRatios, correctionFactors)},
+		{"set without a correction factor", OPCODE_BOLUS__SET_24_CIR_CF_ARRAY, slices.Concat(carbRatios, hourlyRates([]byte{0x2c, 0x01}, []byte{0x00, 0x00})), []byte{ERROR_CODE_COMMAND}},
+		{"set too short", OPCODE_BOLUS__SET_24_CIR_CF_ARRAY, carbRatios, []byte{ERROR_CODE_COMMAND}},
+	})
+}
+
+func TestCalculationInformation(t *testing.T) {
+	var tests = []struct {
+		name     string
+		setup    func(state *SimulatorState)
+		expected []byte
+		// The carbs & the carb ratio
+		expectedCarbohydrate []byte
+	}{
+		{
+			// The target of 90 mg/dL (4.99 mmol/L), the hourly carb ratio & the correction factor of 36 mg/dL, in mmol/L
+			// times 100
+			name:                 "Dana-I in mmol/L",
+			setup:                func(state *SimulatorState) {},
+			expected:             []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0xf3, 0x01, 0x0a, 0x00, 0xc8, 0x00, 0x00, 0x00, UNITS_MMOL},
+			expectedCarbohydrate: []byte{0x00, 0x00, 0x00, 0x0a, 0x00},
+		},
+		{
+			name:                 "Dana-I in mg/dL",
+			setup:                func(state *SimulatorState) { state.Units = UNITS_MG },
+			expected:             []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x5a, 0x00, 0x0a, 0x00, 0x24, 0x00, 0x00, 0x00, UNITS_MG},
+			expectedCarbohydrate: []byte{0x00, 0x00, 0x00, 0x0a, 0x00},
+		},
+		{
+			// The last glucose (7.20 mmol/L) & carbs (45g) of the history
+			name: "with glucose & carbs",
+			setup: func(state *SimulatorState) {
+				state.History = []HistoryItem{
+					{Timestamp: testStartTime, Code: HISTORY_GLUCOSE, Value: 540},
+					{Timestamp: testStartTime, Code: HISTORY_CARBO, Value: 30},
+					{Timestamp: testStartTime, Code: HISTORY_GLUCOSE, Value: 720},
+					{Timestamp: testStartTime, Code: HISTORY_CARBO, Value: 45},
+				}
+			},
+			expected:             []byte{0x00, 0xd0, 0x02, 0x2d, 0x00, 0xf3, 0x01, 0x0a, 0x00, 0xc8, 0x00, 0x00, 0x00, UNITS_MMOL},
+			expectedCarbohydrate: []byte{0x00, 0x2d, 0x00, 0x0a, 0x00},
+		},
+		{
+			// Noon falls in the afternoon block, with a carb ratio of 12 & a correction factor of 54 mg/dL (3.00 mmol/L)
+			name: "DanaRS-v3 block",
+			setup: func(state *SimulatorState) {
+				state.PumpType = PUMP_TYPE_DANA_RS_V3
+				state.CarbRatios = []float32{10, 12, 15, 20}
+				state.CorrectionFactors = []float32{36, 54, 36, 36}
+			},
+			expected:             []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0xf3, 0x01, 0x0c, 0x00, 0x2c, 0x01, 0x00, 0x00, UNITS_MMOL},
+			expectedCarbohydrate: []byte{0x00, 0x00, 0x00, 0x0c, 0x00},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state = NewState()
+			test.setup(&state)
+
+			var _, client, _ = startLoopbackWithState(t, state)
+
+			var response, err = client.Command(OPCODE_BOLUS__GET_CALCULATION_INFORMATION, []byte{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(response, test.expected) {
+				t.Errorf("calculation information: expected %v, got %v", test.expected, response)
+			}
+
+			response, err = client.Command(OPCODE_BOLUS__GET_CARBOHYDRATE_CALCULATION_INFORMATION, []byte{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(response, test.expectedCarbohydrate) {
+				t.Errorf("carbohydrate calculation information: expected %v, got %v", test.expectedCarbohydrate, response)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	// The pump has 4 missed bolus reminder windows
+	MISSED_BOLUS_WINDOW_COUNT = 4
+
+	DEFAULT_BOLUS_STEP float32 = 0.05
+)
+
+// Bolus steps (in U) the pump supports
+var BolusSteps = []float32{0.05, 0.1, 0.5, 1}
+
+// MissedBolusWindow raises the missed bolus alarm at the end of the window, when no bolus has been given in it. A
+// window which starts & ends at the same time is disabled
+type MissedBolusWindow struct {
+	StartHour   int
+	StartMinute int
+	EndHour     int
+	EndMinute   int
+}
+
+func (c *CommandCenter) respondToGetBolusOption() {
+	var message = []byte{0, byte(c.state.BolusCalculationOption), 0}
+	if c.state.IsExtendedBolusEnabled {
+		message[0] = 1
+	}
+	if c.state.IsMissedBolusReminderEnabled {
+		message[2] = 1
+	}
+
+	for _, window := range c.state.MissedBolusWindows {
+		message = append(message, byte(window.StartHour), byte(window.StartMinute), byte(window.EndHour), byte(window.EndMinute))
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__GET_BOLUS_OPTION - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BOLUS__GET_BOLUS_OPTION, message)
+}
+
+func (c *CommandCenter) respondToSetBolusOption(request []byte) {
+	if len(request) < 5+MISSED_BOLUS_WINDOW_COUNT*4 {
+		c.rejectBolusOption(OPCODE_BOLUS__SET_BOLUS_OPTION, "request too short")
+		return
+	}
+
+	var windows = make([]MissedBolusWindow, MISSED_BOLUS_WINDOW_COUNT)
+	for i := range windows {
+		var data = request[5+i*4:]
+		windows[i] = MissedBolusWindow{
+			StartHour:   int(data[0]),
+			StartMinute: int(data[1]),
+			EndHour:     int(data[2]),
+			EndMinute:   int(data[3]),
+		}
+
+		if windows[i].StartHour > 23 || windows[i].StartMinute > 59 || windows[i].EndHour > 23 || windows[i].EndMinute > 59 {
+			c.rejectBolusOption(OPCODE_BOLUS__SET_BOLUS_OPTION, "invalid missed bolus window "+fmt.Sprint(i))
+			return
+		}
+	}
+
+	c.state.IsExtendedBolusEnabled = request[2] == 1
+	c.state.BolusCalculationOption = int(request[3])
+	c.state.IsMissedBolusReminderEnabled = request[4] == 1
+	c.state.MissedBolusWindows = windows
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_BOLUS_OPTION - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE_BOLUS__SET_BOLUS_OPTION, []byte{0x00})
+}
+
+// respondToGetBolusRate sends the max bolus & the bolus step, both times 100. AAPS lists the opcode (0x4c in
+// BleEncryption) but has no packet for it, so there is no reference layout: the simulator reuses the encoding of the
+// max bolus & bolus step in OPCODE_BOLUS__GET_STEP_BOLUS_INFORMATION, behind the usual error byte
+func (c *CommandCenter) respondToGetBolusRate() {
+	var maxBolus = int(math.Round(float64(c.state.MaxBolus) * 100))
+	var message = []byte{
+		0x00,
+		byte(maxBolus), byte(maxBolus >> 8),
+		byte(math.Round(float64(c.state.BolusStep) * 100)),
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__GET_BOLUS_RATE - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BOLUS__GET_BOLUS_RATE, message)
+}
+
+// respondToSetBolusRate stores the max bolus & the bolus step, in the layout of respondToGetBolusRate without the error
+// byte. Like the get, this layout is the simulator's own as AAPS never sends the opcode (0x4d)
+func (c *CommandCenter) respondToSetBolusRate(request []byte) {
+	if len(request) < 5 {
+		c.rejectBolusOption(OPCODE_BOLUS__SET_BOLUS_RATE, "request too short")
+		return
+	}
+
+	var maxBolus = int(request[2]) | int(request[3])<<8
+	var bolusStep = float32(request[4]) / 100
+
+	if maxBolus <= 0 {
+		c.rejectBolusOption(OPCODE_BOLUS__SET_BOLUS_RATE, "max bolus must be above 0U")
+		return
+	}
+	if !slices.Contains(BolusSteps, bolusStep) {
+		c.rejectBolusOption(OPCODE_BOLUS__SET_BOLUS_RATE, "unsupported bolus step "+fmt.Sprint(bolusStep)+"U")
+		return
+	}
+
+	c.state.MaxBolus = float32(maxBolus) / 100
+	c.state.BolusStep = bolusStep
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_BOLUS_RATE - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE_BOLUS__SET_BOLUS_RATE, []byte{0x00})
+}
+
+func (c *CommandCenter) rejectBolusOption(code byte, reason string) {
+	fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting bolus option, " + reason + " - Data: " + base64.StdEncoding.EncodeToString([]byte{ERROR_CODE_COMMAND}))
+	c.encodeAndWrite(code, []byte{ERROR_CODE_COMMAND})
+}
+
+// isBolusStep returns true if the amount is a multiple of the bolus step
+func (c *CommandCenter) isBolusStep(amount float32) bool {
+	var step = int(math.Round(float64(c.state.BolusStep) * 100))
+	return step <= 0 || int(math.Round(float64(amount)*100))%step == 0
+}
+
+// checkMissedBolus raises the missed bolus alarm for every window which ended since the last check without a bolus
+func (c *CommandCenter) checkMissedBolus() {
+	var now = c.clock.Now()
+	var checkedAt = c.missedBolusCheckedAt
+	c.missedBolusCheckedAt = now
+
+	if checkedAt.IsZero() || !c.state.IsMissedBolusReminderEnabled {
+		return
+	}
+
+	// The window might have ended on the day of the last check, or today
+	var days = []time.Time{now}
+	if checkedAt.Year() != now.Year() || checkedAt.YearDay() != now.YearDay() {
+		days = []time.Time{checkedAt, now}
+	}
+
+	for _, window := range c.state.MissedBolusWindows {
+		if window.StartHour == window.EndHour && window.StartMinute == window.EndMinute {
+			continue
+		}
+
+		for _, day := range days {
+			var end = time.Date(day.Year(), day.Month(), day.Day(), window.EndHour, window.EndMinute, 0, 0, day.Location())
+			if !end.After(checkedAt) || end.After(now) {
+				continue
+			}
+
+			var start = time.Date(day.Year(), day.Month(), day.Day(), window.StartHour, window.StartMinute, 0, 0, day.Location())
+			if !start.Before(end) {
+				// The window runs over midnight
+				start = start.AddDate(0, 0, -1)
+			}
+
+			if !c.hasBolusBetween(start, end) {
+				fmt.Println(time.Now().Format(time.RFC3339) + " WARNING: Missed bolus between " + start.Format("15:04") + " and " + end.Format("15:04"))
+				c.encodeAndNotify(OPCODE_NOTIFY__MISSED_BOLUS_ALARM, []byte{byte(window.StartHour), byte(window.StartMinute), byte(window.EndHour), byte(window.EndMinute)})
+			}
+		}
+	}
+}
+
+// hasBolusBetween returns true if a bolus started within the time range, including the running bolus
+func (c *CommandCenter) hasBolusBetween(start time.Time, end time.Time) bool {
+	if c.bolusTicker != nil {
+		return true
+	}
+	if c.state.ExtendedBolusStartedAt != nil && !c.state.ExtendedBolusStartedAt.Before(start) {
+		return true
+	}
+
+	for _, item := range c.state.History {
+		if item.Code == HISTORYBOLUS && !item.Timestamp.Before(start) && item.Timestamp.Before(end) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBolusOption(t *testing.T) {
+	var _, client, _ = startLoopback(t, PUMP_TYPE_DANA_I)
+
+	// Extended bolus enabled, calculation option, missed bolus reminder enabled & the 4 windows (start & end hour, minute)
+	var option = []byte{0x01, 0x00, 0x01, 7, 0, 9, 0, 12, 0, 14, 30, 18, 0, 20, 0, 0, 0, 0, 0}
+
+	runCommandTests(t, client, []commandTest{
+		{"defaults", OPCODE_BOLUS__GET_BOLUS_OPTION, []byte{}, []byte{0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"set", OPCODE_BOLUS__SET_BOLUS_OPTION, option, []byte{0x00}},
+		{"get", OPCODE_BOLUS__GET_BOLUS_OPTION, []byte{}, option},
+		{"set invalid window", OPCODE_BOLUS__SET_BOLUS_OPTION, []byte{0x00, 0x00, 0x01, 7, 0, 24, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{ERROR_CODE_COMMAND}},
+		{"set too short", OPCODE_BOLUS__SET_BOLUS_OPTION, option[:15], []byte{ERROR_CODE_COMMAND}},
+		{"unchanged", OPCODE_BOLUS__GET_BOLUS_OPTION, []byte{}, option},
+	})
+}
+
+func TestBolusRate(t *testing.T) {
+	var _, client, _ = startLoopback(t, PUMP_TYPE_DANA_I)
+
+	runCommandTests(t, client, []commandTest{
+		// Max bolus of 10U & bolus step of 0.05U, both times 100
+		{"defaults", OPCODE_BOLUS__GET_BOLUS_RATE, []byte{}, []byte{0x00, 0xe8, 0x03, 0x05}},
+		{"set", OPCODE_BOLUS__SET_BOLUS_RATE, []byte{0xe2, 0x04, 0x0a}, []byte{0x00}},
+		{"get", OPCODE_BOLUS__GET_BOLUS_RATE, []byte{}, []byte{0x00, 0xe2, 0x04, 0x0a}},
+		{"set without max bolus", OPCODE_BOLUS__SET_BOLUS_RATE, []byte{0x00, 0x00, 0x0a}, []byte{ERROR_CODE_COMMAND}},
+		{"set unsupported step", OPCODE_BOLUS__SET_BOLUS_RATE, []byte{0xe8, 0x03, 0x07}, []byte{ERROR_CODE_COMMAND}},
+		{"set too short", OPCODE_BOLUS__SET_BOLUS_RATE, []byte{0xe8, 0x03}, []byte{ERROR_CODE_COMMAND}},
+		{"unchanged", OPCODE_BOLUS__GET_BOLUS_RATE, []byte{}, []byte{0x00, 0xe2, 0x04, 0x0a}},
+		// 0.15U is not a multiple of the 0.1U step, 12.6U is above the max bolus of 12.5U
+		{"bolus off the step", OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{0x0f, 0x00, 0x00}, []byte{ERROR_CODE_COMMAND}},
+		{"bolus above max bolus", OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{0xec, 0x04, 0x00}, []byte{ERROR_CODE_MAX_BOLUS_VIOLATION}},
+	})
+}
+
+func TestMissedBolusAlarm(t *testing.T) {
+	var tests = []struct {
+		name      string
+		isEnabled bool
+		window    MissedBolusWindow
+		bolus     bool
+		duration  time.Duration
+		// The window as notified, nil when no alarm is expected
+		expected []byte
+	}{
+		{"no bolus", true, MissedBolusWindow{11, 0, 12, 30}, false, 31 * time.Minute, []byte{11, 0, 12, 30}},
+		{"bolus in the window", true, MissedBolusWindow{11, 0, 12, 30}, true, 31 * time.Minute, nil},
+		{"window not ended", true, MissedBolusWindow{11, 0, 12, 30}, false, 29 * time.Minute, nil},
+		{"reminder disabled", false, MissedBolusWindow{11, 0, 12, 30}, false, 31 * time.Minute, nil},
+		{"over midnight", true, MissedBolusWindow{23, 0, 1, 0}, false, 13*time.Hour + time.Minute, []byte{23, 0, 1, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state = NewState()
+			state.IsMissedBolusReminderEnabled = test.isEnabled
+			state.MissedBolusWindows[1] = test.window
+
+			var _, client, clock = startLoopbackWithState(t, state)
+			if test.bolus {
+				if err := client.Bolus(1, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			clock.Advance(test.duration)
+
+			// Every notification has been sent once the clock has advanced
+			var alarms = [][]byte{}
+			for {
+				var packet, ok = client.notifications.pop(0)
+				if !ok {
+					break
+				}
+				if packet[1] == OPCODE_NOTIFY__MISSED_BOLUS_ALARM {
+					alarms = append(alarms, packet[2:])
+				}
+			}
+
+			if test.expected == nil && len(alarms) != 0 {
+				t.Errorf("expected no missed bolus alarm, got %v", alarms)
+			}
+			if test.expected != nil && (len(alarms) != 1 || !bytes.Equal(alarms[0], test.expected)) {
+				t.Errorf("expected a missed bolus alarm for %v, got %v", test.expected, alarms)
+			}
+		})
+	}
+}
@@ -0,0 +1,957 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PhoneLink is the phone side of a transport
+type PhoneLink interface {
+	Connect(onReceive func(data []byte))
+	Send(data []byte) error
+}
+
+// Client acts as the phone: it performs the handshake & encryption and exposes the pump commands as typed calls
+type Client struct {
+	// How long to wait for a response or notification from the pump
+	Timeout time.Duration
+
+	// DanaRS-v1 passkey, filled during pairing. Can be set upfront to reconnect without pairing
+	PassKey []byte
+
+	// DanaRS-v3 keys, as shown on the pump during pairing. The Dana-I keys are received during the handshake
+	PairingKeys       []byte
+	RandomPairingKeys []byte
+
+	link        PhoneLink
+	state       *SimulatorState
+	encryption  *DanaEncryption
+	isConnected bool
+
+	mutex         sync.Mutex
+	readBuffer    []byte
+	responses     *packetQueue
+	notifications *packetQueue
+}
+
+type InitialScreenInformation struct {
+	IsSuspended            bool
+	IsExtendedInProgress   bool
+	IsDualBolusInProgress  bool
+	IsTempBasalInProgress  bool
+	DailyTotalUnits        float32
+	MaxDailyTotalUnits     float32
+	ReservoirLevel         float32
+	CurrentBasal           float32
+	TempBasalPercentage    int
+	BatteryRemaining       int
+	ExtendedBolusRemaining float32
+	InsulinOnBoard         float32
+}
+
+func NewClient(link PhoneLink, name string, pumpType int) *Client {
+	var state = SimulatorState{
+		Name:     name,
+		PumpType: pumpType,
+	}
+
+	return &Client{
+		Timeout:       5 * time.Second,
+		link:          link,
+		state:         &state,
+		encryption:    NewDanaEncryption(&state),
+		responses:     newPacketQueue(),
+		notifications: newPacketQueue(),
+	}
+}
+
+// Connect performs the handshake (PUMP_CHECK & TIME_INFORMATION) after which all commands are second lvl encrypted
+func (c *Client) Connect() error {
+	if c.state.PumpType == PUMP_TYPE_DANA_RS_V3 && (len(c.PairingKeys) != 6 || len(c.RandomPairingKeys) != 3) {
+		return errors.New("pairing keys are required for the DanaRS-v3")
+	}
+
+	c.mutex.Lock()
+	c.isConnected = false
+	c.readBuffer = []byte{}
+	c.state.PairingKeys = c.PairingKeys
+	c.state.RandomPairingKeys = c.RandomPairingKeys
+	c.mutex.Unlock()
+
+	c.link.Connect(c.receive)
+
+	var response, err = c.request(TYPE_ENCRYPTION_REQUEST, OPCODE_ENCRYPTION__PUMP_CHECK, []byte(c.state.Name))
+	if err != nil {
+		return err
+	}
+
+	if len(response) < 2 || response[0] != 0x4f || response[1] != 0x4b {
+		return errors.New("pump is busy")
+	}
+
+	if c.state.PumpType == PUMP_TYPE_DANA_I {
+		if len(response) < 12 {
+			return fmt.Errorf("pump check too short, length: %d", len(response))
+		}
+
+		c.state.Ble5Keys = slices.Clone(response[6:12])
+	}
+
+	if c.state.PumpType == PUMP_TYPE_DANA_RS_V1 {
+		if err = c.checkPassKey(); err != nil {
+			return err
+		}
+	}
+
+	response, err = c.request(TYPE_ENCRYPTION_REQUEST, OPCODE_ENCRYPTION__TIME_INFORMATION, []byte{0x01})
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state.PumpType == PUMP_TYPE_DANA_RS_V1 {
+		if len(response) < 8 {
+			return fmt.Errorf("time information too short, length: %d", len(response))
+		}
+
+		c.encryption.timeSecret = slices.Clone(response[0:6])
+		c.encryption.passwordSecret = []byte{response[6] ^ 0x87, response[7] ^ 0x0d}
+		c.state.PassKey = c.PassKey
+	} else if len(response) == 0 || response[0] != 0x00 {
+		return fmt.Errorf("pump rejected time information, response: %v", response)
+	}
+
+	c.isConnected = true
+	if c.state.PumpType == PUMP_TYPE_DANA_RS_V3 {
+		c.encryption.randomSyncKey = initialRandomSyncKey(c.state.PairingKeys)
+	}
+
+	return nil
+}
+
+// checkPassKey verifies the known passkey with the DanaRS-v1, and pairs again if it has been rejected
+func (c *Client) checkPassKey() error {
+	if len(c.PassKey) == 2 {
+		var response, err = c.request(TYPE_ENCRYPTION_REQUEST, OPCODE_ENCRYPTION__CHECK_PASSKEY, []byte{
+			encodePacketPassKeySerialNumber(c.PassKey[0], c.state.Name),
+			encodePacketPassKeySerialNumber(c.PassKey[1], c.state.Name),
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(response) > 0 && response[0] == 0x00 {
+			return nil
+		}
+	}
+
+	var response, err = c.request(TYPE_ENCRYPTION_REQUEST, OPCODE_ENCRYPTION__PASSKEY_REQUEST, []byte{})
+	if err != nil {
+		return err
+	}
+
+	if len(response) == 0 || response[0] != 0x00 {
+		return fmt.Errorf("pump rejected pairing, response: %v", response)
+	}
+
+	var packet, ok = c.responses.pop(c.Timeout)
+	if !ok || packet[1] != OPCODE_ENCRYPTION__PASSKEY_RETURN || len(packet) < 4 {
+		return errors.New("pump did not return a passkey")
+	}
+
+	c.PassKey = []byte{
+		encodePacketPassKeySerialNumber(packet[2], c.state.Name),
+		encodePacketPassKeySerialNumber(packet[3], c.state.Name),
+	}
+
+	return nil
+}
+
+// Command sends a raw command to the pump and returns the data of its response
+func (c *Client) Command(code byte, data []byte) ([]byte, error) {
+	return c.request(TYPE_COMMAND, code, data)
+}
+
+// WaitForNotification skips all notifications until one with the given code has been received
+func (c *Client) WaitForNotification(code byte) ([]byte, error) {
+	for {
+		var packet, ok = c.notifications.pop(c.Timeout)
+		if !ok {
+			return nil, fmt.Errorf("timeout while waiting for notification %d", code)
+		}
+
+		if packet[1] == code {
+			return packet[2:], nil
+		}
+	}
+}
+
+func (c *Client) KeepConnection() error {
+	var _, err = c.Command(OPCODE_ETC__KEEP_CONNECTION, []byte{})
+	return err
+}
+
+func (c *Client) InitialScreenInformation() (InitialScreenInformation, error) {
+	var data, err = c.Command(OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, []byte{})
+	if err != nil {
+		return InitialScreenInformation{}, err
+	}
+
+	if len(data) < 15 {
+		return InitialScreenInformation{}, fmt.Errorf("initial screen information too short, length: %d", len(data))
+	}
+
+	var tempBasalPercentage = int(data[9])
+	if tempBasalPercentage > 200 {
+		tempBasalPercentage = (tempBasalPercentage-200)*10 + 200
+	}
+
+	return InitialScreenInformation{
+		IsSuspended:            data[0]&0x01 == 0x01,
+		IsExtendedInProgress:   data[0]&0x04 == 0x04,
+		IsDualBolusInProgress:  data[0]&0x08 == 0x08,
+		IsTempBasalInProgress:  data[0]&0x10 == 0x10,
+		DailyTotalUnits:        float32(readUint16(data, 1)) / 100,
+		MaxDailyTotalUnits:     float32(readUint16(data, 3)) / 100,
+		ReservoirLevel:         float32(readUint16(data, 5)) / 100,
+		CurrentBasal:           float32(readUint16(data, 7)) / 100,
+		TempBasalPercentage:    tempBasalPercentage,
+		BatteryRemaining:       int(data[10]),
+		ExtendedBolusRemaining: float32(readUint16(data, 11)) / 100,
+		InsulinOnBoard:         float32(readUint16(data, 13)) / 100,
+	}, nil
+}
+
+// Bolus starts a step bolus. speed: 0 = 12 sec/U, 1 = 30 sec/U, 2 = 60 sec/U
+func (c *Client) Bolus(units float32, speed byte) error {
+	var amount = int(math.Round(float64(units * 100)))
+	return c.expectOk(OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{byte(amount), byte(amount >> 8), speed})
+}
+
+func (c *Client) CancelBolus() error {
+	return c.expectOk(OPCODE_BOLUS__SET_STEP_BOLUS_STOP, []byte{})
+}
+
+// ExtendedBolus delivers the units evenly over the duration, in steps of 30 minutes
+func (c *Client) ExtendedBolus(units float32, duration time.Duration) error {
+	var amount = int(math.Round(float64(units * 100)))
+	return c.expectOk(OPCODE_BOLUS__SET_EXTENDED_BOLUS, []byte{byte(amount), byte(amount >> 8), byte(duration / (30 * time.Minute))})
+}
+
+// DualBolus delivers the immediate units right away and the extended units evenly over the duration
+func (c *Client) DualBolus(immediateUnits float32, extendedUnits float32, duration time.Duration) error {
+	var immediateAmount = int(math.Round(float64(immediateUnits * 100)))
+	var extendedAmount = int(math.Round(float64(extendedUnits * 100)))
+
+	return c.expectOk(OPCODE_BOLUS__SET_DUAL_BOLUS, []byte{
+		byte(immediateAmount), byte(immediateAmount >> 8),
+		byte(extendedAmount), byte(extendedAmount >> 8),
+		byte(duration / (30 * time.Minute)),
+	})
+}
+
+func (c *Client) CancelExtendedBolus() error {
+	return c.expectOk(OPCODE_BOLUS__SET_EXTENDED_BOLUS_CANCEL, []byte{})
+}
+
+func (c *Client) SetTempBasal(percentage int, hours int) error {
+	return c.expectOk(OPCODE_BASAL__SET_TEMPORARY_BASAL, []byte{byte(percentage), byte(hours)})
+}
+
+// SetApsTempBasal starts a temp basal of either 15 or 30 minutes
+func (c *Client) SetApsTempBasal(percentage int, duration time.Duration) error {
+	var durationCode byte = 150
+	if duration == 30*time.Minute {
+		durationCode = 160
+	}
+
+	return c.expectOk(OPCODE_BASAL__APS_SET_TEMPORARY_BASAL, []byte{byte(percentage), byte(percentage >> 8), durationCode})
+}
+
+type TempBasalState struct {
+	IsInProgress       bool
+	IsApsTempBasal     bool
+	Percentage         int
+	Duration           time.Duration
+	RunningInMinutes   int
+	RemainingInMinutes int
+}
+
+func (c *Client) TempBasalState() (TempBasalState, error) {
+	var data, err = c.Command(OPCODE_BASAL__TEMPORARY_BASAL_STATE, []byte{})
+	if err != nil {
+		return TempBasalState{}, err
+	}
+
+	if len(data) < 8 {
+		return TempBasalState{}, fmt.Errorf("temp basal state too short, length: %d", len(data))
+	}
+
+	var percentage = int(data[2])
+	if percentage > 200 {
+		percentage = (percentage-200)*10 + 200
+	}
+
+	var duration = time.Duration(data[3]) * time.Hour
+	if data[3] == 150 {
+		duration = 15 * time.Minute
+	} else if data[3] == 160 {
+		duration = 30 * time.Minute
+	}
+
+	return TempBasalState{
+		IsInProgress:       data[1] != 0x00,
+		IsApsTempBasal:     data[1] == 0x02,
+		Percentage:         percentage,
+		Duration:           duration,
+		RunningInMinutes:   int(readUint16(data, 4)),
+		RemainingInMinutes: int(readUint16(data, 6)),
+	}, nil
+}
+
+func (c *Client) CancelTempBasal() error {
+	return c.expectOk(OPCODE_BASAL__CANCEL_TEMPORARY_BASAL, []byte{})
+}
+
+type TodayDeliveryTotal struct {
+	Total float32
+	Basal float32
+	Bolus float32
+}
+
+// TodayDeliveryTotal reads the insulin (in U) delivered since midnight
+func (c *Client) TodayDeliveryTotal() (TodayDeliveryTotal, error) {
+	var data, err = c.Command(OPCODE_REVIEW__GET_TODAY_DELIVERY_TOTAL, []byte{})
+	if err != nil {
+		return TodayDeliveryTotal{}, err
+	}
+
+	if len(data) < 6 {
+		return TodayDeliveryTotal{}, fmt.Errorf("today delivery total too short, length: %d", len(data))
+	}
+
+	return TodayDeliveryTotal{
+		Total: float32(readUint16(data, 0)) / 100,
+		Basal: float32(readUint16(data, 2)) / 100,
+		Bolus: float32(readUint16(data, 4)) / 100,
+	}, nil
+}
+
+// SetHistoryUploadMode has to be enabled before the history can be read
+func (c *Client) SetHistoryUploadMode(enabled bool) error {
+	var mode byte = 0
+	if enabled {
+		mode = 1
+	}
+
+	return c.expectOk(OPCODE_REVIEW__SET_HISTORY_UPLOAD_MODE, []byte{mode})
+}
+
+// History reads the records of a review opcode (or OPCODE_REVIEW__ALL_HISTORY) since the given time. Daily records
+// are decoded back into the layout of the state: Value holds the basal total & Param7/Param8 the bolus total
+func (c *Client) History(code byte, from time.Time) ([]HistoryItem, error) {
+	var request = []byte{
+		byte(from.Year() - 2000),
+		byte(from.Month()),
+		byte(from.Day()),
+		byte(from.Hour()),
+		byte(from.Minute()),
+		byte(from.Second()),
+	}
+	if err := c.send(TYPE_COMMAND, code, request); err != nil {
+		return nil, err
+	}
+
+	var items = []HistoryItem{}
+	for {
+		var packet, ok = c.responses.pop(c.Timeout)
+		if !ok {
+			return nil, fmt.Errorf("timeout while waiting for history on %d", code)
+		}
+
+		if packet[1] != code {
+			return nil, fmt.Errorf("received response for %d while waiting for history on %d", packet[1], code)
+		}
+
+		var data = packet[2:]
+		if len(data) == 3 {
+			if data[0] != 0x00 {
+				return nil, fmt.Errorf("pump rejected history request %d, response: %v", code, data)
+			}
+			return items, nil
+		}
+
+		if len(data) < 11 {
+			return nil, fmt.Errorf("history record too short, length: %d", len(data))
+		}
+
+		var item = HistoryItem{
+			Code:   data[0],
+			Param7: data[7],
+			Param8: data[8],
+			Value:  uint16(data[9])<<8 | uint16(data[10]),
+		}
+		if item.Code == HISTORY_DAILY {
+			item.Timestamp = time.Date(int(data[1])+2000, time.Month(data[2]), int(data[3]), 0, 0, 0, 0, time.Local)
+			item.Value = uint16(data[4])<<8 | uint16(data[5])
+			item.Param7 = data[6]
+			item.Param8 = data[7]
+		} else {
+			item.Timestamp = time.Date(int(data[1])+2000, time.Month(data[2]), int(data[3]), int(data[4]), int(data[5]), int(data[6]), 0, time.Local)
+		}
+
+		items = append(items, item)
+	}
+}
+
+// ApsHistoryEvents reads every APS event (APS_EVENT_*) since the given time
+func (c *Client) ApsHistoryEvents(from time.Time) ([]ApsHistoryEvent, error) {
+	if err := c.send(TYPE_COMMAND, OPCODE__APS_HISTORY_EVENTS, c.encodeHistoryDate(from)); err != nil {
+		return nil, err
+	}
+
+	var events = []ApsHistoryEvent{}
+	for {
+		var data, err = c.WaitForNotification(OPCODE__APS_HISTORY_EVENTS)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(data) < 11 {
+			return nil, fmt.Errorf("APS history event too short, length: %d", len(data))
+		}
+
+		if data[0] == APS_EVENT_DONE {
+			return events, nil
+		}
+
+		var timestamp time.Time
+		if c.state.PumpType == PUMP_TYPE_DANA_I {
+			var epoch = uint32(data[3])<<24 | uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6])
+			timestamp = time.Unix(int64(epoch), 0)
+		} else {
+			timestamp = time.Date(int(data[1])+2000, time.Month(data[2]), int(data[3]), int(data[4]), int(data[5]), int(data[6]), 0, time.Local)
+		}
+
+		events = append(events, ApsHistoryEvent{
+			Timestamp: timestamp,
+			Code:      data[0],
+			Param1:    uint16(data[7])<<8 | uint16(data[8]),
+			Param2:    uint16(data[9])<<8 | uint16(data[10]),
+		})
+	}
+}
+
+// SetEventHistory writes an APS event (APS_EVENT_*) into the history of the pump
+func (c *Client) SetEventHistory(eventType byte, timestamp time.Time, param1 uint16, param2 uint16) error {
+	var request = append([]byte{eventType}, c.encodeHistoryDate(timestamp)...)
+	request = append(request, byte(param1>>8), byte(param1), byte(param2>>8), byte(param2))
+
+	return c.expectOk(OPCODE__APS_SET_EVENT_HISTORY, request)
+}
+
+// SaveHistory writes a record, like a blood glucose measurement, into the history of the pump
+func (c *Client) SaveHistory(code byte, timestamp time.Time, param8 byte, value uint16) error {
+	var request = append([]byte{code}, c.encodeHistoryDate(timestamp)...)
+	request = append(request, param8, byte(value), byte(value>>8))
+
+	return c.expectOk(OPCODE_ETC__SET_HISTORY_SAVE, request)
+}
+
+func (c *Client) encodeHistoryDate(timestamp time.Time) []byte {
+	if c.state.PumpType == PUMP_TYPE_DANA_I {
+		timestamp = timestamp.UTC()
+	}
+
+	return []byte{
+		byte(timestamp.Year() - 2000),
+		byte(timestamp.Month()),
+		byte(timestamp.Day()),
+		byte(timestamp.Hour()),
+		byte(timestamp.Minute()),
+		byte(timestamp.Second()),
+	}
+}
+
+// BolusAverage reads the average daily bolus total (in U) over the last 3, 7, 14, 21 & 28 days
+func (c *Client) BolusAverage() ([]float32, error) {
+	var data, err = c.Command(OPCODE_REVIEW__BOLUS_AVG, []byte{})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(bolusAverageDays)*2 {
+		return nil, fmt.Errorf("bolus average too short, length: %d", len(data))
+	}
+
+	var averages = make([]float32, len(bolusAverageDays))
+	for i := range averages {
+		averages[i] = float32(readUint16(data, i*2)) / 100
+	}
+
+	return averages, nil
+}
+
+type BolusOption struct {
+	IsExtendedBolusEnabled       bool
+	BolusCalculationOption       int
+	IsMissedBolusReminderEnabled bool
+	MissedBolusWindows           []MissedBolusWindow
+}
+
+func (c *Client) GetBolusOption() (BolusOption, error) {
+	var data, err = c.Command(OPCODE_BOLUS__GET_BOLUS_OPTION, []byte{})
+	if err != nil {
+		return BolusOption{}, err
+	}
+
+	if len(data) < 3+MISSED_BOLUS_WINDOW_COUNT*4 {
+		return BolusOption{}, fmt.Errorf("bolus option too short, length: %d", len(data))
+	}
+
+	var option = BolusOption{
+		IsExtendedBolusEnabled:       data[0] == 1,
+		BolusCalculationOption:       int(data[1]),
+		IsMissedBolusReminderEnabled: data[2] == 1,
+	}
+	for i := 0; i < MISSED_BOLUS_WINDOW_COUNT; i++ {
+		var window = data[3+i*4:]
+		option.MissedBolusWindows = append(option.MissedBolusWindows, MissedBolusWindow{
+			StartHour:   int(window[0]),
+			StartMinute: int(window[1]),
+			EndHour:     int(window[2]),
+			EndMinute:   int(window[3]),
+		})
+	}
+
+	return option, nil
+}
+
+// SetBolusOption writes the bolus options, missing missed bolus windows are disabled
+func (c *Client) SetBolusOption(option BolusOption) error {
+	var request = make([]byte, 3+MISSED_BOLUS_WINDOW_COUNT*4)
+	if option.IsExtendedBolusEnabled {
+		request[0] = 1
+	}
+	request[1] = byte(option.BolusCalculationOption)
+	if option.IsMissedBolusReminderEnabled {
+		request[2] = 1
+	}
+	for i, window := range option.MissedBolusWindows[:min(len(option.MissedBolusWindows), MISSED_BOLUS_WINDOW_COUNT)] {
+		copy(request[3+i*4:], []byte{byte(window.StartHour), byte(window.StartMinute), byte(window.EndHour), byte(window.EndMinute)})
+	}
+
+	return c.expectOk(OPCODE_BOLUS__SET_BOLUS_OPTION, request)
+}
+
+type BolusRate struct {
+	MaxBolus  float32
+	BolusStep float32
+}
+
+func (c *Client) GetBolusRate() (BolusRate, error) {
+	var data, err = c.Command(OPCODE_BOLUS__GET_BOLUS_RATE, []byte{})
+	if err != nil {
+		return BolusRate{}, err
+	}
+
+	if len(data) < 4 {
+		return BolusRate{}, fmt.Errorf("bolus rate too short, length: %d", len(data))
+	}
+
+	return BolusRate{
+		MaxBolus:  float32(readUint16(data, 1)) / 100,
+		BolusStep: float32(data[3]) / 100,
+	}, nil
+}
+
+func (c *Client) SetBolusRate(maxBolus float32, bolusStep float32) error {
+	var request = make([]byte, 3)
+	writeUint16(request, 0, uint16(math.Round(float64(maxBolus)*100)))
+	request[2] = byte(math.Round(float64(bolusStep) * 100))
+
+	return c.expectOk(OPCODE_BOLUS__SET_BOLUS_RATE, request)
+}
+
+// CirCf holds the carb ratios (in g/U) & correction factors (in the units of the pump, per U) of the bolus calculator
+type CirCf struct {
+	Units             int
+	CarbRatios        []float32
+	CorrectionFactors []float32
+}
+
+// GetCirCf reads the carb ratios & correction factors of the 4 blocks of the day
+func (c *Client) GetCirCf() (CirCf, error) {
+	var data, err = c.Command(OPCODE_BOLUS__GET_CIR_CF_ARRAY, []byte{})
+	if err != nil {
+		return CirCf{}, err
+	}
+
+	if len(data) < 2+CIR_CF_SLOT_COUNT*2*2 {
+		return CirCf{}, fmt.Errorf("CIR/CF array too short, length: %d", len(data))
+	}
+
+	var cirCf = CirCf{Units: int(data[1])}
+	for slot := 0; slot < CIR_CF_SLOT_COUNT; slot += 2 {
+		cirCf.CarbRatios = append(cirCf.CarbRatios, float32(readUint16(data, 2+slot*2)))
+		cirCf.CorrectionFactors = append(cirCf.CorrectionFactors, decodeClientGlucose(readUint16(data, 2+(CIR_CF_SLOT_COUNT+slot)*2), cirCf.Units))
+	}
+
+	return cirCf, nil
+}
+
+// SetCirCf writes the carb ratios & correction factors of the 4 blocks of the day, in the units of the pump
+func (c *Client) SetCirCf(carbRatios []float32, correctionFactors []float32, units int) error {
+	var request = make([]byte, CIR_CF_SLOT_COUNT*2*2)
+	for block := 0; block < CIR_CF_BLOCK_COUNT; block++ {
+		var slot = block * 2
+		writeUint16(request, slot*2, uint16(carbRatios[block]))
+		writeUint16(request, (CIR_CF_SLOT_COUNT+slot)*2, encodeClientGlucose(correctionFactors[block], units))
+	}
+
+	return c.expectOk(OPCODE_BOLUS__SET_CIR_CF_ARRAY, request)
+}
+
+// Get24CirCf reads the carb ratios & correction factors of every hour
+func (c *Client) Get24CirCf() (CirCf, error) {
+	var data, err = c.Command(OPCODE_BOLUS__GET_24_CIR_CF_ARRAY, []byte{})
+	if err != nil {
+		return CirCf{}, err
+	}
+
+	if len(data) < 1+CIR_CF_HOUR_COUNT*2*2 {
+		return CirCf{}, fmt.Errorf("24 CIR/CF array too short, length: %d", len(data))
+	}
+
+	var cirCf = CirCf{Units: int(data[0])}
+	for hour := 0; hour < CIR_CF_HOUR_COUNT; hour++ {
+		cirCf.CarbRatios = append(cirCf.CarbRatios, float32(readUint16(data, 1+hour*2)))
+		cirCf.CorrectionFactors = append(cirCf.CorrectionFactors, decodeClientGlucose(readUint16(data, 1+(CIR_CF_HOUR_COUNT+hour)*2), cirCf.Units))
+	}
+
+	return cirCf, nil
+}
+
+// Set24CirCf writes the carb ratios & correction factors of every hour, in the units of the pump
+func (c *Client) Set24CirCf(carbRatios []float32, correctionFactors []float32, units int) error {
+	var request = make([]byte, CIR_CF_HOUR_COUNT*2*2)
+	for hour := 0; hour < CIR_CF_HOUR_COUNT; hour++ {
+		writeUint16(request, hour*2, uint16(carbRatios[hour]))
+		writeUint16(request, (CIR_CF_HOUR_COUNT+hour)*2, encodeClientGlucose(correctionFactors[hour], units))
+	}
+
+	return c.expectOk(OPCODE_BOLUS__SET_24_CIR_CF_ARRAY, request)
+}
+
+type CalculationInformation struct {
+	CurrentBg        float32
+	Carbohydrate     int
+	TargetBg         float32
+	CarbRatio        float32
+	CorrectionFactor float32
+	InsulinOnBoard   float32
+	Units            int
+}
+
+// CalculationInformation reads the input of the bolus calculator, glucose values are in the units of the pump
+func (c *Client) CalculationInformation() (CalculationInformation, error) {
+	var data, err = c.Command(OPCODE_BOLUS__GET_CALCULATION_INFORMATION, []byte{})
+	if err != nil {
+		return CalculationInformation{}, err
+	}
+
+	if len(data) < 14 {
+		return CalculationInformation{}, fmt.Errorf("calculation information too short, length: %d", len(data))
+	}
+
+	var units = int(data[13])
+	return CalculationInformation{
+		CurrentBg:        decodeClientGlucose(readUint16(data, 1), units),
+		Carbohydrate:     int(readUint16(data, 3)),
+		TargetBg:         decodeClientGlucose(readUint16(data, 5), units),
+		CarbRatio:        float32(readUint16(data, 7)),
+		CorrectionFactor: decodeClientGlucose(readUint16(data, 9), units),
+		InsulinOnBoard:   float32(readUint16(data, 11)) / 100,
+		Units:            units,
+	}, nil
+}
+
+func decodeClientGlucose(value uint16, units int) float32 {
+	if units == UNITS_MMOL {
+		return float32(value) / 100
+	}
+
+	return float32(value)
+}
+
+func encodeClientGlucose(value float32, units int) uint16 {
+	if units == UNITS_MMOL {
+		return uint16(math.Round(float64(value) * 100))
+	}
+
+	return uint16(math.Round(float64(value)))
+}
+
+type BasalRate struct {
+	MaxBasal  float32
+	BasalStep float32
+	Rates     []float32
+}
+
+// GetBasalRate reads the 24 hourly rates (in U/hr) of the active basal profile
+func (c *Client) GetBasalRate() (BasalRate, error) {
+	var data, err = c.Command(OPCODE_BASAL__GET_BASAL_RATE, []byte{})
+	if err != nil {
+		return BasalRate{}, err
+	}
+
+	if len(data) < 3+24*2 {
+		return BasalRate{}, fmt.Errorf("basal rate too short, length: %d", len(data))
+	}
+
+	var rates = make([]float32, 24)
+	for i := range rates {
+		rates[i] = float32(readUint16(data, 3+i*2)) / 100
+	}
+
+	return BasalRate{
+		MaxBasal:  float32(readUint16(data, 0)) / 100,
+		BasalStep: float32(data[2]) / 100,
+		Rates:     rates,
+	}, nil
+}
+
+// SetBasalRate writes the 24 hourly rates (in U/hr) of the active basal profile
+func (c *Client) SetBasalRate(rates []float32) error {
+	if len(rates) != 24 {
+		return fmt.Errorf("expected 24 hourly rates, got %d", len(rates))
+	}
+
+	return c.expectOk(OPCODE_BASAL__SET_BASAL_RATE, encodeBasalRates(rates))
+}
+
+func (c *Client) GetProfileNumber() (int, error) {
+	var data, err = c.Command(OPCODE_BASAL__GET_PROFILE_NUMBER, []byte{})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(data) < 1 {
+		return 0, fmt.Errorf("profile number too short, length: %d", len(data))
+	}
+
+	return int(data[0]), nil
+}
+
+func (c *Client) SetProfileNumber(profileNumber int) error {
+	return c.expectOk(OPCODE_BASAL__SET_PROFILE_NUMBER, []byte{byte(profileNumber)})
+}
+
+// GetProfileBasalRate reads the 24 hourly rates (in U/hr) of a basal profile
+func (c *Client) GetProfileBasalRate(profileNumber int) ([]float32, error) {
+	var data, err = c.Command(OPCODE_BASAL__GET_PROFILE_BASAL_RATE, []byte{byte(profileNumber)})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 24*2 {
+		return nil, fmt.Errorf("profile basal rate too short, length: %d", len(data))
+	}
+
+	var rates = make([]float32, 24)
+	for i := range rates {
+		rates[i] = float32(readUint16(data, i*2)) / 100
+	}
+
+	return rates, nil
+}
+
+// SetProfileBasalRate writes the 24 hourly rates (in U/hr) of a basal profile
+func (c *Client) SetProfileBasalRate(profileNumber int, rates []float32) error {
+	if len(rates) != 24 {
+		return fmt.Errorf("expected 24 hourly rates, got %d", len(rates))
+	}
+
+	return c.expectOk(OPCODE_BASAL__SET_PROFILE_BASAL_RATE, append([]byte{byte(profileNumber)}, encodeBasalRates(rates)...))
+}
+
+func encodeBasalRates(rates []float32) []byte {
+	var data = []byte{}
+	for _, rate := range rates {
+		var value = int(math.Round(float64(rate * 100)))
+		data = append(data, byte(value), byte(value>>8))
+	}
+
+	return data
+}
+
+func (c *Client) Suspend() error {
+	return c.expectOk(OPCODE_BASAL__SET_SUSPEND_ON, []byte{})
+}
+
+func (c *Client) Resume() error {
+	return c.expectOk(OPCODE_BASAL__SET_SUSPEND_OFF, []byte{})
+}
+
+func (c *Client) expectOk(code byte, data []byte) error {
+	var response, err = c.Command(code, data)
+	if err != nil {
+		return err
+	}
+
+	if len(response) == 0 || response[0] != 0x00 {
+		return fmt.Errorf("pump rejected command %d, response: %v", code, response)
+	}
+
+	return nil
+}
+
+func (c *Client) request(packetType byte, code byte, data []byte) ([]byte, error) {
+	if err := c.send(packetType, code, data); err != nil {
+		return nil, err
+	}
+
+	var packet, ok = c.responses.pop(c.Timeout)
+	if !ok {
+		return nil, fmt.Errorf("timeout while waiting for response on %d", code)
+	}
+
+	if packet[1] != code {
+		return nil, fmt.Errorf("received response for %d while waiting for %d", packet[1], code)
+	}
+
+	return packet[2:], nil
+}
+
+func (c *Client) send(packetType byte, code byte, data []byte) error {
+	var length = len(data)
+	var buffer = make([]byte, 9+length)
+	buffer[0] = PACKET_START_BYTE
+	buffer[1] = PACKET_START_BYTE
+	buffer[2] = byte(length) + 0x02
+	buffer[3] = packetType
+	buffer[4] = code
+	copy(buffer[5:], data)
+
+	var crc = generateCrc(buffer[3:5+length], c.state.PumpType, packetType == TYPE_ENCRYPTION_REQUEST)
+	buffer[5+length] = byte(crc >> 8)
+	buffer[6+length] = byte(crc & 0xff)
+	buffer[7+length] = PACKET_END_BYTE
+	buffer[8+length] = PACKET_END_BYTE
+
+	buffer = encodePacketSerialNumber(&buffer, c.state.Name)
+
+	// The pump is mirrored here: the second lvl decryption of the pump is the phone's encryption and vice versa
+	c.mutex.Lock()
+	if c.isConnected && c.state.PumpType == PUMP_TYPE_DANA_RS_V1 && packetType != TYPE_ENCRYPTION_REQUEST {
+		buffer = encodePacketTime(&buffer, c.encryption.timeSecret)
+		buffer = encodePacketPassword(&buffer, c.encryption.passwordSecret)
+		buffer = encodePacketPassKey(&buffer, c.encryption.passKeySecret())
+	} else if c.isConnected && c.state.PumpType != PUMP_TYPE_DANA_RS_V1 {
+		buffer = c.encryption.EncryptionSecondLvl(buffer)
+	}
+	c.mutex.Unlock()
+
+	for index := 0; index < len(buffer); index += 20 {
+		if err := c.link.Send(buffer[index:min(index+20, len(buffer))]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) receive(data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isConnected && c.state.PumpType != PUMP_TYPE_DANA_RS_V1 {
+		data = c.encryption.DecryptionSecondLvl(data)
+	}
+
+	c.readBuffer = append(c.readBuffer, data...)
+	for len(c.readBuffer) >= 3 && len(c.readBuffer) >= int(c.readBuffer[2])+7 {
+		var length = int(c.readBuffer[2]) + 7
+		var packet = slices.Clone(c.readBuffer[:length])
+		c.readBuffer = c.readBuffer[length:]
+
+		packet = encodePacketSerialNumber(&packet, c.state.Name)
+		if c.isConnected && c.state.PumpType == PUMP_TYPE_DANA_RS_V1 && packet[3] != TYPE_ENCRYPTION_RESPONSE {
+			packet = encodePacketTime(&packet, c.encryption.timeSecret)
+			packet = encodePacketPassword(&packet, c.encryption.passwordSecret)
+			packet = encodePacketPassKey(&packet, c.encryption.passKeySecret())
+		}
+
+		var content = packet[3 : length-4]
+		var crc = generateCrc(content, c.state.PumpType, content[0] == TYPE_ENCRYPTION_RESPONSE)
+		if byte(crc>>8) != packet[length-4] || byte(crc&0xff) != packet[length-3] {
+			fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Client received packet with mismatching CRC")
+			continue
+		}
+
+		if content[0] == TYPE_NOTIFY {
+			c.notifications.push(content)
+		} else {
+			c.responses.push(content)
+		}
+	}
+}
+
+func readUint16(data []byte, index int) uint16 {
+	return uint16(data[index]) | (uint16(data[index+1]) << 8)
+}
+
+func writeUint16(data []byte, index int, value uint16) {
+	data[index] = byte(value)
+	data[index+1] = byte(value >> 8)
+}
+
+// packetQueue is an unbounded queue, so the pump never blocks on a phone which isnt reading
+type packetQueue struct {
+	mutex   sync.Mutex
+	packets [][]byte
+	signal  chan struct{}
+}
+
+func newPacketQueue() *packetQueue {
+	return &packetQueue{signal: make(chan struct{}, 1)}
+}
+
+func (q *packetQueue) push(packet []byte) {
+	q.mutex.Lock()
+	q.packets = append(q.packets, packet)
+	q.mutex.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (q *packetQueue) pop(timeout time.Duration) ([]byte, bool) {
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		q.mutex.Lock()
+		if len(q.packets) > 0 {
+			var packet = q.packets[0]
+			q.packets = q.packets[1:]
+			q.mutex.Unlock()
+			return packet, true
+		}
+		q.mutex.Unlock()
+
+		select {
+		case <-q.signal:
+		case <-timer.C:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the simulator. Besides the real time, the pump can run on a fixed clock (for
+// deterministic tests) or an accelerated clock (to run a full day in minutes)
+type Clock interface {
+	Now() time.Time
+	NewTicker(interval time.Duration) Ticker
+}
+
+// Ticker ticks on an interval of the clock it has been created by. Call Handled once a tick has been processed, the
+// FixedClock waits for it
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Handled()
+}
+
+// RealClock follows the time of the machine
+type RealClock struct{}
+
+func NewRealClock() *RealClock {
+	return &RealClock{}
+}
+
+func (c *RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *RealClock) NewTicker(interval time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(interval)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+func (t *realTicker) Handled() {}
+
+// AcceleratedClock starts at the given time and runs a factor faster than the real time, so a speed of 60 runs an
+// hour of pump time in a minute
+type AcceleratedClock struct {
+	realStart time.Time
+	start     time.Time
+	speed     float64
+}
+
+func NewAcceleratedClock(start time.Time, speed float64) *AcceleratedClock {
+	return &AcceleratedClock{
+		realStart: time.Now(),
+		start:     start,
+		speed:     speed,
+	}
+}
+
+func (c *AcceleratedClock) Now() time.Time {
+	var elapsed = time.Since(c.realStart)
+	return c.start.Add(time.Duration(float64(elapsed) * c.speed))
+}
+
+func (c *AcceleratedClock) NewTicker(interval time.Duration) Ticker {
+	var realInterval = max(time.Duration(float64(interval)/c.speed), time.Millisecond)
+	return &realTicker{ticker: time.NewTicker(realInterval)}
+}
+
+// FixedClock only moves when it is told to. Tickers fire while advancing the clock, just like they would have in
+// real time. Every tick is delivered & handled before the clock moves on, so the simulator has caught up once Advance
+// returns
+type FixedClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*fixedTicker
+}
+
+func NewFixedClock(now time.Time) *FixedClock {
+	return &FixedClock{now: now}
+}
+
+func (c *FixedClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// Set moves the clock to the given time, without firing any ticker
+func (c *FixedClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = now
+	for _, ticker := range c.tickers {
+		ticker.next = now.Add(ticker.interval)
+	}
+}
+
+// Advance moves the clock forward, firing every ticker which is due on the way
+func (c *FixedClock) Advance(duration time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var till = c.now.Add(duration)
+	for {
+		var next *fixedTicker
+		for _, ticker := range c.tickers {
+			if !ticker.next.After(till) && (next == nil || ticker.next.Before(next.next)) {
+				next = ticker
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		c.now = next.next
+		next.next = next.next.Add(next.interval)
+
+		// The tick handler reads the clock & might start or stop tickers, so the clock is unlocked while it runs
+		var now = c.now
+		c.mutex.Unlock()
+		next.tick(now)
+		c.mutex.Lock()
+	}
+
+	c.now = till
+}
+
+func (c *FixedClock) NewTicker(interval time.Duration) Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var ticker = &fixedTicker{
+		clock:    c,
+		channel:  make(chan time.Time),
+		handled:  make(chan struct{}, 1),
+		stopped:  make(chan struct{}),
+		interval: interval,
+		next:     c.now.Add(interval),
+	}
+	c.tickers = append(c.tickers, ticker)
+
+	return ticker
+}
+
+type fixedTicker struct {
+	clock    *FixedClock
+	channel  chan time.Time
+	handled  chan struct{}
+	stopped  chan struct{}
+	interval time.Duration
+	next     time.Time
+}
+
+// tick delivers the tick & waits till it has been handled, unless the ticker gets stopped in the meantime
+func (t *fixedTicker) tick(now time.Time) {
+	select {
+	case t.channel <- now:
+	case <-t.stopped:
+		return
+	}
+
+	select {
+	case <-t.handled:
+	case <-t.stopped:
+	}
+}
+
+func (t *fixedTicker) Handled() {
+	select {
+	case t.handled <- struct{}{}:
+	default:
+	}
+}
+
+func (t *fixedTicker) C() <-chan time.Time {
+	return t.channel
+}
+
+func (t *fixedTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	for i, ticker := range t.clock.tickers {
+		if ticker == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			close(t.stopped)
+			break
+		}
+	}
+}
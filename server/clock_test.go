@@ -0,0 +1,165 @@
+package server
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+type tick struct {
+	ticker int
+	at     time.Time
+}
+
+// recordTicks handles the ticks of the tickers in the background & records them in the order they arrived
+func recordTicks(tickers []Ticker) *[]tick {
+	var ticks = []tick{}
+	for i, ticker := range tickers {
+		go func() {
+			for now := range ticker.C() {
+				ticks = append(ticks, tick{i, now})
+				ticker.Handled()
+			}
+		}()
+	}
+
+	return &ticks
+}
+
+func TestFixedClockAdvance(t *testing.T) {
+	var start = time.Date(2026, 3, 14, 23, 59, 30, 0, time.UTC)
+	var at = func(offset time.Duration) time.Time {
+		return start.Add(offset)
+	}
+
+	var tests = []struct {
+		name      string
+		intervals []time.Duration
+		advances  []time.Duration
+		expected  []tick
+	}{
+		{"every tick", []time.Duration{10 * time.Second}, []time.Duration{35 * time.Second}, []tick{
+			{0, at(10 * time.Second)}, {0, at(20 * time.Second)}, {0, at(30 * time.Second)},
+		}},
+		{"ticks between advances", []time.Duration{10 * time.Second}, []time.Duration{5 * time.Second, 5 * time.Second, 25 * time.Second}, []tick{
+			{0, at(10 * time.Second)}, {0, at(20 * time.Second)}, {0, at(30 * time.Second)},
+		}},
+		{"tickers in order", []time.Duration{10 * time.Second, 15 * time.Second}, []time.Duration{30 * time.Second}, []tick{
+			{0, at(10 * time.Second)}, {1, at(15 * time.Second)}, {0, at(20 * time.Second)}, {0, at(30 * time.Second)}, {1, at(30 * time.Second)},
+		}},
+		{"across midnight", []time.Duration{time.Minute}, []time.Duration{2 * time.Minute}, []tick{
+			{0, time.Date(2026, 3, 15, 0, 0, 30, 0, time.UTC)}, {0, time.Date(2026, 3, 15, 0, 1, 30, 0, time.UTC)},
+		}},
+		{"no tick before the interval", []time.Duration{time.Hour}, []time.Duration{59 * time.Minute}, []tick{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var clock = NewFixedClock(start)
+			var tickers = []Ticker{}
+			for _, interval := range test.intervals {
+				tickers = append(tickers, clock.NewTicker(interval))
+			}
+			var ticks = recordTicks(tickers)
+
+			var advanced = time.Duration(0)
+			for _, advance := range test.advances {
+				clock.Advance(advance)
+				advanced += advance
+			}
+
+			if len(*ticks) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, *ticks)
+			}
+			for i, tick := range *ticks {
+				if tick.ticker != test.expected[i].ticker || !tick.at.Equal(test.expected[i].at) {
+					t.Errorf("expected %v, got %v", test.expected, *ticks)
+					break
+				}
+			}
+			if !clock.Now().Equal(start.Add(advanced)) {
+				t.Errorf("expected the clock at %v, got %v", start.Add(advanced), clock.Now())
+			}
+		})
+	}
+}
+
+func TestFixedClockStopWhileTicking(t *testing.T) {
+	var clock = NewFixedClock(testStartTime)
+	var ticker = clock.NewTicker(time.Second)
+
+	// Stopped instead of handled, like the bolus ticker does once the bolus is delivered
+	go func() {
+		<-ticker.C()
+		ticker.Stop()
+	}()
+
+	var done = make(chan struct{})
+	go func() {
+		clock.Advance(time.Minute)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the clock to advance past a stopped ticker")
+	}
+	if !clock.Now().Equal(testStartTime.Add(time.Minute)) {
+		t.Errorf("expected the clock at %v, got %v", testStartTime.Add(time.Minute), clock.Now())
+	}
+}
+
+func TestBasalDeliveryAcrossDst(t *testing.T) {
+	var amsterdam, err = time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var local = func(month time.Month, day int, hour int) time.Time {
+		return time.Date(2026, month, day, hour, 0, 0, 0, amsterdam)
+	}
+	var cet = time.FixedZone("CET", 3600)
+	var cest = time.FixedZone("CEST", 7200)
+
+	var tests = []struct {
+		name     string
+		start    time.Time
+		duration time.Duration
+		expected []HistoryItem
+	}{
+		{"midnight", local(time.March, 14, 23), 2 * time.Hour, []HistoryItem{
+			{Code: HISTORY_BASALHOUR, Timestamp: local(time.March, 14, 23), Value: 100},
+			{Code: HISTORY_DAILY, Timestamp: local(time.March, 14, 0), Value: 100},
+			{Code: HISTORY_BASALHOUR, Timestamp: local(time.March, 15, 0), Value: 100},
+		}},
+		// 02:00 CET is followed by 03:00 CEST
+		{"spring forward", local(time.March, 29, 1), 2 * time.Hour, []HistoryItem{
+			{Code: HISTORY_BASALHOUR, Timestamp: time.Date(2026, 3, 29, 1, 0, 0, 0, cet), Value: 100},
+			{Code: HISTORY_BASALHOUR, Timestamp: time.Date(2026, 3, 29, 3, 0, 0, 0, cest), Value: 100},
+		}},
+		// 03:00 CEST is followed by 02:00 CET, so the hour from 02:00 is delivered twice
+		{"fall back", local(time.October, 25, 1), 3 * time.Hour, []HistoryItem{
+			{Code: HISTORY_BASALHOUR, Timestamp: time.Date(2026, 10, 25, 1, 0, 0, 0, cest), Value: 100},
+			{Code: HISTORY_BASALHOUR, Timestamp: time.Date(2026, 10, 25, 2, 0, 0, 0, cest), Value: 100},
+			{Code: HISTORY_BASALHOUR, Timestamp: time.Date(2026, 10, 25, 2, 0, 0, 0, cet), Value: 100},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var simulator, clock = startOnFixedClock(t, NewState(), test.start)
+			clock.Advance(test.duration)
+
+			var history = simulator.State.History
+			if len(history) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, history)
+			}
+			for i, item := range history {
+				var expected = test.expected[i]
+				if item.Code != expected.Code || !item.Timestamp.Equal(expected.Timestamp) || item.Value != expected.Value {
+					t.Errorf("expected %+v, got %+v", expected, item)
+				}
+			}
+		})
+	}
+}
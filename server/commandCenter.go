@@ -5,18 +5,31 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math"
+	"sync"
 	"time"
-
-	"tinygo.org/x/bluetooth"
 )
 
 type CommandCenter struct {
-	encryption          *DanaEncryption
-	state               *SimulatorState
-	writeCharacteristic *bluetooth.Characteristic
+	encryption *DanaEncryption
+	state      *SimulatorState
+	transport  Transport
+	clock      Clock
+
+	// Guards the state & encryption against the background tickers
+	mutex sync.Mutex
+
+	bolusTicker    Ticker
+	bolusType      byte
+	bolusStartedAt time.Time
+	currentAmount  float32
 
-	bolusTicker   *time.Ticker
-	currentAmount float32
+	extendedBolusTicker Ticker
+	deliveryTicker      Ticker
+
+	missedBolusCheckedAt time.Time
+
+	// Set once a phone completed the handshake, reset when a new phone starts one
+	isPhoneConnected bool
 }
 
 func (c *CommandCenter) ProcessEncryptionCommand(data []byte) {
@@ -27,6 +40,12 @@ func (c *CommandCenter) ProcessEncryptionCommand(data []byte) {
 	case OPCODE_ENCRYPTION__TIME_INFORMATION:
 		c.respondToTimeRequest(data)
 		return
+	case OPCODE_ENCRYPTION__CHECK_PASSKEY:
+		c.respondToCheckPassKey(data)
+		return
+	case OPCODE_ENCRYPTION__PASSKEY_REQUEST:
+		c.respondToPassKeyRequest()
+		return
 	}
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: UNIMPLEMENTED ENCRYPTION COMMAND: " + fmt.Sprint(data[1]))
@@ -35,11 +54,21 @@ func (c *CommandCenter) ProcessEncryptionCommand(data []byte) {
 func (c *CommandCenter) ProcessCommand(data []byte) {
 	var command = data[1]
 
+	// Any use of the pump postpones the shutdown, but costs some battery
+	var now = c.clock.Now()
+	c.state.LastInteractionAt = &now
+	c.drainBattery(c.state.BatteryDrainPerCommand)
+
 	if !c.state.IsInHistoryUploadMode && command >= OPCODE_REVIEW__BOLUS_AVG && command <= OPCODE_REVIEW__ALL_HISTORY {
 		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Trying to do a history command while not in history upload mode...")
 		return
 	}
 
+	if command == OPCODE_REVIEW__BOLUS_AVG {
+		c.respondToBolusAverage()
+		return
+	}
+
 	if command >= OPCODE_REVIEW__BOLUS_AVG && command <= OPCODE_REVIEW__ALL_HISTORY {
 		var date = getDate(data, 0, time.Local)
 		c.respondToHistoryRequest(command, date)
@@ -84,7 +113,13 @@ func (c *CommandCenter) ProcessCommand(data []byte) {
 		c.respondToSetBasal(data)
 		return
 	case OPCODE_BASAL__SET_PROFILE_NUMBER:
-		c.respondToSetBasalProfile()
+		c.respondToSetBasalProfile(data)
+		return
+	case OPCODE_BASAL__GET_PROFILE_NUMBER:
+		c.respondToGetBasalProfile()
+		return
+	case OPCODE_BASAL__GET_PROFILE_BASAL_RATE:
+		c.respondToGetBasalProfileRate(data)
 		return
 	case OPCODE_BASAL__SET_SUSPEND_ON:
 		c.respondToSuspend(true)
@@ -93,26 +128,86 @@ func (c *CommandCenter) ProcessCommand(data []byte) {
 		c.respondToSuspend(false)
 		return
 	case OPCODE_BASAL__SET_TEMPORARY_BASAL:
-		c.respondToTempBasal(OPCODE_BASAL__SET_TEMPORARY_BASAL, int(data[2]), time.Duration(data[3])*time.Hour)
+		c.respondToTempBasal(data)
 		return
 	case OPCODE_BASAL__APS_SET_TEMPORARY_BASAL:
-		var percentage = int(data[2]) + (int(data[3]) << 8)
-		var duration time.Duration = time.Duration(15 * time.Second)
-		if data[4] == 160 {
-			duration = time.Duration(30 * time.Second)
-		}
-
-		c.respondToTempBasal(OPCODE_BASAL__APS_SET_TEMPORARY_BASAL, percentage, duration)
+		c.respondToApsTempBasal(data)
 		return
 	case OPCODE_BASAL__CANCEL_TEMPORARY_BASAL:
 		c.respondToStopTempBasal()
 		return
+	case OPCODE_BASAL__TEMPORARY_BASAL_STATE:
+		c.respondToTempBasalState()
+		return
+	case OPCODE__APS_HISTORY_EVENTS:
+		c.respondToApsHistoryEvents(data)
+		return
+	case OPCODE__APS_SET_EVENT_HISTORY:
+		c.respondToSetEventHistory(data)
+		return
+	case OPCODE_ETC__SET_HISTORY_SAVE:
+		c.respondToSetHistorySave(data)
+		return
+	case OPCODE_BOLUS__GET_BOLUS_OPTION:
+		c.respondToGetBolusOption()
+		return
+	case OPCODE_BOLUS__SET_BOLUS_OPTION:
+		c.respondToSetBolusOption(data)
+		return
+	case OPCODE_BOLUS__GET_BOLUS_RATE:
+		c.respondToGetBolusRate()
+		return
+	case OPCODE_BOLUS__SET_BOLUS_RATE:
+		c.respondToSetBolusRate(data)
+		return
+	case OPCODE_BOLUS__GET_CIR_CF_ARRAY:
+		c.respondToGetCirCfArray()
+		return
+	case OPCODE_BOLUS__SET_CIR_CF_ARRAY:
+		c.respondToSetCirCfArray(data)
+		return
+	case OPCODE_BOLUS__GET_24_CIR_CF_ARRAY:
+		c.respondToGet24CirCfArray()
+		return
+	case OPCODE_BOLUS__SET_24_CIR_CF_ARRAY:
+		c.respondToSet24CirCfArray(data)
+		return
+	case OPCODE_BOLUS__GET_CALCULATION_INFORMATION:
+		c.respondToCalculationInformation()
+		return
+	case OPCODE_BOLUS__GET_CARBOHYDRATE_CALCULATION_INFORMATION:
+		c.respondToCarbohydrateCalculationInformation()
+		return
+	case OPCODE_REVIEW__GET_TODAY_DELIVERY_TOTAL:
+		c.respondToTodayDeliveryTotal()
+		return
 	case OPCODE_BASAL__GET_BASAL_RATE:
 		c.respondToBasalGetRate()
 		return
+	case OPCODE_BASAL__SET_BASAL_RATE:
+		c.respondToBasalSetRate(data)
+		return
 	case OPCODE_BOLUS__GET_STEP_BOLUS_INFORMATION:
 		c.respondToBolusStepInformation()
 		return
+	case OPCODE_BOLUS__SET_EXTENDED_BOLUS:
+		c.respondToExtendedBolusStart(data)
+		return
+	case OPCODE_BOLUS__SET_EXTENDED_BOLUS_CANCEL:
+		c.respondToExtendedBolusCancel()
+		return
+	case OPCODE_BOLUS__GET_EXTENDED_BOLUS_STATE:
+		c.respondToExtendedBolusState()
+		return
+	case OPCODE_BOLUS__GET_EXTENDED_BOLUS:
+		c.respondToGetExtendedBolus()
+		return
+	case OPCODE_BOLUS__SET_DUAL_BOLUS:
+		c.respondToDualBolusStart(data)
+		return
+	case OPCODE_BOLUS__GET_DUAL_BOLUS:
+		c.respondToGetDualBolus()
+		return
 	}
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: UNIMPLEMENTED COMMAND: " + fmt.Sprint(data[1]))
@@ -125,6 +220,8 @@ func (c *CommandCenter) respondToCommandRequest() {
 		return
 	}
 
+	c.isPhoneConnected = false
+
 	var data = c.encryption.Encryption(EncryptionParams{operationCode: OPCODE_ENCRYPTION__PUMP_CHECK, data: []byte{}, isEncryptionCommand: true})
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_ENCRYPTION__PUMP_CHECK - Data: " + base64.StdEncoding.EncodeToString(data))
@@ -132,22 +229,66 @@ func (c *CommandCenter) respondToCommandRequest() {
 }
 
 func (c *CommandCenter) respondToTimeRequest(request []byte) {
-	if request[2] == 1 {
+	if len(request) > 2 && request[2] == 1 {
 		c.encryption.ResetRandomSyncKey()
 
 		fmt.Println("---------------------------------------")
-		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Pairing key: " + hex.EncodeToString(pairingKeys))
-		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Random pairing key: " + hex.EncodeToString(randomPairingKeys))
+		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Pairing key: " + hex.EncodeToString(c.state.PairingKeys))
+		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Random pairing key: " + hex.EncodeToString(c.state.RandomPairingKeys))
 		fmt.Println("---------------------------------------")
 	}
 
 	var data = c.encryption.Encryption(EncryptionParams{operationCode: OPCODE_ENCRYPTION__TIME_INFORMATION, data: []byte{}, isEncryptionCommand: true})
+	c.isPhoneConnected = true
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_ENCRYPTION__TIME_INFORMATION - Data: " + base64.StdEncoding.EncodeToString(data))
 	c.write(data)
 }
 
-func (c CommandCenter) respondToKeepConnection() {
+func (c *CommandCenter) respondToCheckPassKey(request []byte) {
+	if c.state.PumpType != PUMP_TYPE_DANA_RS_V1 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " WARNING: OPCODE_ENCRYPTION__CHECK_PASSKEY is only supported on the DanaRS-v1")
+		return
+	}
+
+	var message = []byte{0x00}
+	if !c.encryption.DecodePassKey(request) {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Received passkey does not match, phone needs to pair again")
+		message = []byte{0x01}
+	}
+
+	var data = c.encryption.encodeMessage(message, OPCODE_ENCRYPTION__CHECK_PASSKEY, true, false)
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_ENCRYPTION__CHECK_PASSKEY - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.write(data)
+}
+
+func (c *CommandCenter) respondToPassKeyRequest() {
+	if c.state.PumpType != PUMP_TYPE_DANA_RS_V1 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " WARNING: OPCODE_ENCRYPTION__PASSKEY_REQUEST is only supported on the DanaRS-v1")
+		return
+	}
+
+	var passKey = c.encryption.GeneratePassKey()
+	c.state.Save()
+
+	fmt.Println("---------------------------------------")
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Passkey: " + hex.EncodeToString(passKey))
+	fmt.Println("---------------------------------------")
+
+	var data = c.encryption.encodeMessage([]byte{0x00}, OPCODE_ENCRYPTION__PASSKEY_REQUEST, true, false)
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_ENCRYPTION__PASSKEY_REQUEST - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.write(data)
+
+	// The pump shows the passkey and the user confirms it right away
+	data = c.encryption.Encryption(EncryptionParams{operationCode: OPCODE_ENCRYPTION__PASSKEY_RETURN, data: []byte{}, isEncryptionCommand: true})
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_ENCRYPTION__PASSKEY_RETURN - Data: " + base64.StdEncoding.EncodeToString(data))
+	c.write(data)
+}
+
+func (c *CommandCenter) respondToKeepConnection() {
 	var data = c.encryption.Encryption(EncryptionParams{operationCode: OPCODE_ETC__KEEP_CONNECTION, data: []byte{0}, isEncryptionCommand: false})
 	data = c.encryption.EncryptionSecondLvl(data)
 
@@ -155,12 +296,20 @@ func (c CommandCenter) respondToKeepConnection() {
 	c.write(data)
 }
 
-func (c CommandCenter) respondToInitialScreenInformation() {
-	// TODO: Add isExtendedInProgress & isDualBolusInProgress
+func (c *CommandCenter) respondToInitialScreenInformation() {
+	// Expire the temp basal & extended bolus first, so the status & the values agree
+	c.updateBasalDelivery()
+
 	var status byte = 0
 	if c.state.IsSuspended {
 		status += 0x01
 	}
+	if c.state.ExtendedBolusActiveTill != nil && !c.state.IsDualBolus {
+		status += 0x04
+	}
+	if c.state.ExtendedBolusActiveTill != nil && c.state.IsDualBolus {
+		status += 0x08
+	}
 	if c.state.TempBasalActiveTill != nil {
 		status += 0x10
 	}
@@ -172,13 +321,15 @@ func (c CommandCenter) respondToInitialScreenInformation() {
 	var message = make([]byte, length)
 	message[0] = status
 
-	// dailyTotalUnits - Not used
-	message[1] = 0
-	message[2] = 0
+	// dailyTotalUnits
+	var dailyTotalUnits = int(math.Round(float64(c.state.TodayBasalDelivered+c.state.TodayBolusDelivered) * 100))
+	message[1] = byte(dailyTotalUnits)
+	message[2] = byte(dailyTotalUnits >> 8)
 
-	// maxDailyTotalUnits - Not used
-	message[3] = 0
-	message[4] = 250
+	// maxDailyTotalUnits
+	var maxDailyTotalUnits = c.state.MaxDailyTotal * 100
+	message[3] = byte(maxDailyTotalUnits)
+	message[4] = byte(maxDailyTotalUnits >> 8)
 
 	var reservoirLevel = int(c.state.ReservoirLevel * 100)
 	message[5] = byte(reservoirLevel)
@@ -190,31 +341,51 @@ func (c CommandCenter) respondToInitialScreenInformation() {
 	message[8] = byte(currentBasal >> 8)
 
 	// tempBasalPercent - Not used
-	message[9] = byte(c.state.TempBasalPercentage)
+	message[9] = encodeTempBasalPercentage(c.state.TempBasalPercentage)
 
 	// batteryRemaining
 	message[10] = byte(c.state.BatteryRemaining)
 
-	// extendedBolusAbsoluteRemaining - Not used
-	message[11] = 0
-	message[12] = 0
+	// extendedBolusAbsoluteRemaining
+	var extendedBolusRemaining = int((c.state.ExtendedBolusAmount - c.state.ExtendedBolusDelivered) * 100)
+	message[11] = byte(extendedBolusRemaining)
+	message[12] = byte(extendedBolusRemaining >> 8)
 
-	// insulinOnBoard - Not used
-	message[13] = 0
-	message[14] = 0
+	// insulinOnBoard
+	var insulinOnBoard = int(c.insulinOnBoard() * 100)
+	message[13] = byte(insulinOnBoard)
+	message[14] = byte(insulinOnBoard >> 8)
 
 	if c.state.PumpType == PUMP_TYPE_DANA_I {
-		// error state - Not used
-		message[15] = 0
+		// error state
+		message[15] = c.errorState()
 	}
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION - Data: " + base64.StdEncoding.EncodeToString(message))
 	c.encodeAndWrite(OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, message)
 }
 
-func (c CommandCenter) respondToGetTime() {
+func (c *CommandCenter) respondToTodayDeliveryTotal() {
+	c.updateBasalDelivery()
+
+	// Rounded, as the basal is summed up from many small parts
+	var basal = int(math.Round(float64(c.state.TodayBasalDelivered) * 100))
+	var bolus = int(math.Round(float64(c.state.TodayBolusDelivered) * 100))
+	var total = basal + bolus
+
+	var message = []byte{
+		byte(total), byte(total >> 8),
+		byte(basal), byte(basal >> 8),
+		byte(bolus), byte(bolus >> 8),
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_REVIEW__GET_TODAY_DELIVERY_TOTAL - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_REVIEW__GET_TODAY_DELIVERY_TOTAL, message)
+}
+
+func (c *CommandCenter) respondToGetTime() {
 	var duration = time.Duration(c.state.PumpTimeSkewInSeconds * int(time.Second))
-	var now = time.Now().Add(duration)
+	var now = c.clock.Now().Add(duration)
 
 	var message = make([]byte, 6)
 	message[0] = byte(now.Year() - 2000)
@@ -228,7 +399,7 @@ func (c CommandCenter) respondToGetTime() {
 	c.encodeAndWrite(OPCODE_OPTION__GET_PUMP_TIME, message)
 }
 
-func (c CommandCenter) respondToGetTimeWithUtc() {
+func (c *CommandCenter) respondToGetTimeWithUtc() {
 	if c.state.PumpType != PUMP_TYPE_DANA_I {
 		fmt.Println(time.Now().Format(time.RFC3339) + " WARNING: OPCODE_OPTION__GET_PUMP_UTC_AND_TIME_ZONE is only supported on the Dana-I")
 		return
@@ -237,7 +408,7 @@ func (c CommandCenter) respondToGetTimeWithUtc() {
 	var duration = time.Duration(c.state.PumpTimeSkewInSeconds * int(time.Second))
 
 	var timeZone = time.FixedZone("EDT", c.state.PumpTimeZoneOffsetInSeconds)
-	var now = time.Now().Add(duration).In(timeZone).UTC()
+	var now = c.clock.Now().Add(duration).In(timeZone).UTC()
 
 	var message = make([]byte, 7)
 	message[0] = byte(now.Year() - 2000)
@@ -252,7 +423,7 @@ func (c CommandCenter) respondToGetTimeWithUtc() {
 	c.encodeAndWrite(OPCODE_OPTION__GET_PUMP_UTC_AND_TIME_ZONE, message)
 }
 
-func (c CommandCenter) respondToGetUserOptions() {
+func (c *CommandCenter) respondToGetUserOptions() {
 	var length = 18
 	if c.state.PumpType == PUMP_TYPE_DANA_I {
 		length = 20
@@ -287,8 +458,9 @@ func (c CommandCenter) respondToGetUserOptions() {
 	message[17] = 1 // Selectable language 5
 
 	if c.state.PumpType == PUMP_TYPE_DANA_I {
-		message[18] = byte(c.state.TargetBg)
-		message[19] = byte(c.state.TargetBg >> 8)
+		var targetBg = c.encodeGlucose(c.state.TargetBg)
+		message[18] = byte(targetBg)
+		message[19] = byte(targetBg >> 8)
 	}
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_OPTION__GET_USER_OPTION - Data: " + base64.StdEncoding.EncodeToString(message))
@@ -309,7 +481,7 @@ func (c *CommandCenter) respondToSetUserOptions(request []byte) {
 	c.state.RefillAmount = int(request[13]) | (int(request[14]) << 8)
 
 	if c.state.PumpType == PUMP_TYPE_DANA_I {
-		c.state.TargetBg = int(request[15]) | (int(request[16]) << 8)
+		c.state.TargetBg = c.decodeGlucose(int(request[15]) | (int(request[16]) << 8))
 	}
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_OPTION__SET_USER_OPTION - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
@@ -323,47 +495,8 @@ func (c *CommandCenter) respondToSetHistoryMode(enabled bool) {
 	c.encodeAndWrite(OPCODE_REVIEW__SET_HISTORY_UPLOAD_MODE, []byte{0x00})
 }
 
-func (c *CommandCenter) respondToHistoryRequest(code byte, from time.Time) {
-	var filterOnDate = func(h HistoryItem) bool { return h.timestamp.After(from) }
-	var filterOnCode = func(h HistoryItem) bool { return h.code == code }
-
-	var items = filter(c.state.History, filterOnDate)
-	if code != OPCODE_REVIEW__ALL_HISTORY {
-		items = filter(items, filterOnCode)
-	}
-
-	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Uploading history items. Count: " + fmt.Sprint(items))
-
-	for _, item := range items {
-		var message = make([]byte, 11)
-		message[0] = item.code - 0x0f
-		message[1] = byte(item.timestamp.Year() - 2000)
-		message[2] = byte(item.timestamp.Month())
-		message[3] = byte(item.timestamp.Day())
-		message[4] = byte(item.timestamp.Hour())
-		message[5] = byte(item.timestamp.Minute())
-		message[6] = byte(item.timestamp.Second())
-		message[7] = byte(item.param7)
-		message[8] = byte(item.param8)
-		message[9] = byte(item.value)
-		message[10] = byte(item.value << 8)
-
-		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending hisory item - Data: " + base64.StdEncoding.EncodeToString(message))
-		c.encodeAndWrite(code, message)
-	}
-
-	// Send upload done message
-	var message = make([]byte, 3)
-	message[0] = 0
-	message[1] = 0
-	message[2] = 0
-
-	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Done uploading history - Data: " + base64.StdEncoding.EncodeToString(message))
-	c.encodeAndWrite(code, message)
-}
-
 func (c *CommandCenter) respondToSetTime(request []byte) {
-	var pumpTime = time.Now().Add(time.Duration(c.state.PumpTimeSkewInSeconds * int(time.Second)))
+	var pumpTime = c.clock.Now().Add(time.Duration(c.state.PumpTimeSkewInSeconds * int(time.Second)))
 	var requestTime = getDate(request, 0, time.Local)
 
 	var diff = pumpTime.Sub(requestTime)
@@ -375,7 +508,7 @@ func (c *CommandCenter) respondToSetTime(request []byte) {
 }
 
 func (c *CommandCenter) respondToSetTimeWithUtc(request []byte) {
-	var pumpTime = time.Now().UTC().Add(time.Duration(c.state.PumpTimeSkewInSeconds * int(time.Second)))
+	var pumpTime = c.clock.Now().UTC().Add(time.Duration(c.state.PumpTimeSkewInSeconds * int(time.Second)))
 	var requestTime = getDate(request, 0, time.UTC)
 
 	var diff = pumpTime.Sub(requestTime)
@@ -388,19 +521,35 @@ func (c *CommandCenter) respondToSetTimeWithUtc(request []byte) {
 }
 
 func (c *CommandCenter) respondToBolusStart(request []byte) {
-	if c.state.IsSuspended {
-		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Pump is suspended, rejecting bolus" + base64.StdEncoding.EncodeToString([]byte{0x01}))
-		c.encodeAndWrite(OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{0x01})
+	if len(request) < 5 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting bolus, request too short - Data: " + base64.StdEncoding.EncodeToString([]byte{ERROR_CODE_COMMAND}))
+		c.encodeAndWrite(OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{ERROR_CODE_COMMAND})
 		return
 	}
 
-	var amount = float32(request[2]) + float32(int(request[3])<<8)
+	var amount = float32(int(request[2])|(int(request[3])<<8)) / 100
 	var speed = request[4]
 
+	var errorCode = c.checkBolus(amount)
+	if errorCode == ERROR_CODE_NONE && c.bolusTicker != nil {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Bolus is already running")
+		errorCode = ERROR_CODE_BOLUS_TIMEOUT
+	}
+	if errorCode == ERROR_CODE_NONE && speed > 2 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Invalid bolus speed: " + fmt.Sprint(speed))
+		errorCode = ERROR_CODE_SPEED
+	}
+
+	if errorCode != ERROR_CODE_NONE {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting bolus - Data: " + base64.StdEncoding.EncodeToString([]byte{errorCode}))
+		c.encodeAndWrite(OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{errorCode})
+		return
+	}
+
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_STEP_BOLUS_START - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
 	c.encodeAndWrite(OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{0x00})
 
-	c.doBolus(amount/100, speed)
+	c.doBolus(amount, speed, BOLUS_TYPE_STEP)
 }
 
 func (c *CommandCenter) respondToCancelBolus() {
@@ -412,7 +561,7 @@ func (c *CommandCenter) respondToCancelBolus() {
 		c.bolusTicker.Stop()
 		c.bolusTicker = nil
 
-		c.storeBolus(c.currentAmount)
+		c.storeBolus(c.bolusStartedAt, c.currentAmount, c.bolusType, 0)
 	}
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_STEP_BOLUS_STOP - Data: " + base64.StdEncoding.EncodeToString(message))
@@ -420,26 +569,86 @@ func (c *CommandCenter) respondToCancelBolus() {
 }
 
 func (c *CommandCenter) respondToSetBasal(message []byte) {
-	var basalSchedule = make([]float32, 48)
-	for i := 2; i < len(message)-1; i += 2 {
-		var rate = (float32(int(message[i])<<8) + float32(message[i+1])) / 100
-		basalSchedule[(i/2)-1] = rate
+	if len(message) < 3+24*2 || int(message[2]) >= BASAL_PROFILE_COUNT {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Invalid basal profile - Data: " + base64.StdEncoding.EncodeToString([]byte{0x01}))
+		c.encodeAndWrite(OPCODE_BASAL__SET_PROFILE_BASAL_RATE, []byte{0x01})
+		return
 	}
 
-	c.state.BasalSchedule = basalSchedule
+	var profileNumber = int(message[2])
+	var schedule = decodeHourlyBasalRates(message[3:])
+	if errorCode := c.checkBasalRates(schedule); errorCode != ERROR_CODE_NONE {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting basal profile - Data: " + base64.StdEncoding.EncodeToString([]byte{errorCode}))
+		c.encodeAndWrite(OPCODE_BASAL__SET_PROFILE_BASAL_RATE, []byte{errorCode})
+		return
+	}
+
+	c.state.BasalProfiles[profileNumber] = schedule
 	c.state.Save()
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BASAL__SET_PROFILE_BASAL_RATE - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
 	c.encodeAndWrite(OPCODE_BASAL__SET_PROFILE_BASAL_RATE, []byte{0x00})
 }
 
-func (c *CommandCenter) respondToSetBasalProfile() {
+func (c *CommandCenter) respondToGetBasalProfileRate(request []byte) {
+	if len(request) < 3 || int(request[2]) >= BASAL_PROFILE_COUNT {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Invalid basal profile requested")
+		c.encodeAndWrite(OPCODE_BASAL__GET_PROFILE_BASAL_RATE, make([]byte, 24*2))
+		return
+	}
+
+	var message = encodeHourlyBasalRates(c.state.BasalProfiles[request[2]])
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Get profile basal rate - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BASAL__GET_PROFILE_BASAL_RATE, message)
+}
+
+func (c *CommandCenter) respondToSetBasalProfile(request []byte) {
+	if len(request) < 3 || int(request[2]) >= BASAL_PROFILE_COUNT {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Invalid basal profile - Data: " + base64.StdEncoding.EncodeToString([]byte{0x01}))
+		c.encodeAndWrite(OPCODE_BASAL__SET_PROFILE_NUMBER, []byte{0x01})
+		return
+	}
+
+	c.state.ActiveBasalProfile = int(request[2])
+	c.state.History = append(c.state.History, HistoryItem{
+		Timestamp: c.clock.Now(),
+		Code:      HISTORY_PROFILE_CHANGE,
+		Value:     uint16(c.state.ActiveBasalProfile),
+	})
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Switched to basal profile " + fmt.Sprint(c.state.ActiveBasalProfile))
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BASAL__SET_PROFILE_NUMBER - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
 	c.encodeAndWrite(OPCODE_BASAL__SET_PROFILE_NUMBER, []byte{0x00})
 }
 
+func (c *CommandCenter) respondToGetBasalProfile() {
+	var message = []byte{byte(c.state.ActiveBasalProfile)}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Get profile number - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BASAL__GET_PROFILE_NUMBER, message)
+}
+
 func (c *CommandCenter) respondToSuspend(activated bool) {
+	if c.state.IsSuspended != activated {
+		// Param8 holds 'O' when the pump got suspended & 'F' when it got resumed
+		var param8 byte = 'F'
+		if activated {
+			param8 = 'O'
+		}
+		c.state.History = append(c.state.History, HistoryItem{
+			Timestamp: c.clock.Now(),
+			Code:      HISTORY_SUSPEND,
+			Param8:    param8,
+		})
+	}
+
 	c.state.IsSuspended = activated
+	if activated && c.state.ExtendedBolusActiveTill != nil {
+		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Pump got suspended, stopping extended bolus")
+		c.stopExtendedBolus()
+	}
 	c.state.Save()
 
 	if activated {
@@ -452,75 +661,161 @@ func (c *CommandCenter) respondToSuspend(activated bool) {
 }
 
 func (c *CommandCenter) respondToStopTempBasal() {
+	c.updateBasalDelivery()
 	if c.state.TempBasalActiveTill == nil {
 		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: No acitve temp basal, nothing to canel - Data: " + base64.StdEncoding.EncodeToString([]byte{0x01}))
 		c.encodeAndWrite(OPCODE_BASAL__CANCEL_TEMPORARY_BASAL, []byte{0x01})
 		return
 	}
 
-	c.state.TempBasalPercentage = 100
-	c.state.TempBasalActiveTill = nil
-	c.state.Save()
+	c.stopTempBasal(c.clock.Now())
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BASAL__CANCEL_TEMPORARY_BASAL - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
 	c.encodeAndWrite(OPCODE_BASAL__CANCEL_TEMPORARY_BASAL, []byte{0x00})
 }
 
-func (c *CommandCenter) respondToTempBasal(code byte, percentage int, duration time.Duration) {
-	if percentage > 200 && duration > 15*time.Second {
-		// reject any temp basal command which is bigger than 200% that isnt 15 min long
-		c.encodeAndWrite(code, []byte{0x01})
+// respondToTempBasal sets an hourly temp basal: 0-200% in steps of 10%, for 1-24 hours
+func (c *CommandCenter) respondToTempBasal(request []byte) {
+	if len(request) < 4 {
+		c.rejectTempBasal(OPCODE_BASAL__SET_TEMPORARY_BASAL, "request too short")
+		return
+	}
+
+	var percentage = int(request[2])
+	var hours = int(request[3])
+	if percentage > 200 || percentage%10 != 0 {
+		c.rejectTempBasal(OPCODE_BASAL__SET_TEMPORARY_BASAL, "percentage "+fmt.Sprint(percentage)+"% is not within 0-200% in steps of 10%")
+		return
+	}
+	if hours < 1 || hours > 24 {
+		c.rejectTempBasal(OPCODE_BASAL__SET_TEMPORARY_BASAL, "duration of "+fmt.Sprint(hours)+" hours is not within 1-24 hours")
+		return
+	}
+
+	c.startTempBasal(OPCODE_BASAL__SET_TEMPORARY_BASAL, percentage, time.Duration(hours)*time.Hour)
+}
+
+// respondToApsTempBasal sets a temp basal for 15 (duration code 150) or 30 (duration code 160) minutes: 0-500% in
+// steps of 10%, where anything above 200% is only allowed for 15 minutes
+func (c *CommandCenter) respondToApsTempBasal(request []byte) {
+	if len(request) < 5 {
+		c.rejectTempBasal(OPCODE_BASAL__APS_SET_TEMPORARY_BASAL, "request too short")
+		return
+	}
+
+	var percentage = int(request[2]) + (int(request[3]) << 8)
+	var duration time.Duration
+	switch request[4] {
+	case 150:
+		duration = 15 * time.Minute
+	case 160:
+		duration = 30 * time.Minute
+	default:
+		c.rejectTempBasal(OPCODE_BASAL__APS_SET_TEMPORARY_BASAL, "unknown duration code "+fmt.Sprint(request[4]))
 		return
 	}
 
-	var activeTill = time.Now().Add(duration)
+	if percentage > 500 || percentage%10 != 0 {
+		c.rejectTempBasal(OPCODE_BASAL__APS_SET_TEMPORARY_BASAL, "percentage "+fmt.Sprint(percentage)+"% is not within 0-500% in steps of 10%")
+		return
+	}
+	if percentage > 200 && duration != 15*time.Minute {
+		c.rejectTempBasal(OPCODE_BASAL__APS_SET_TEMPORARY_BASAL, "percentage "+fmt.Sprint(percentage)+"% above 200% is only allowed for 15 minutes")
+		return
+	}
+
+	c.startTempBasal(OPCODE_BASAL__APS_SET_TEMPORARY_BASAL, percentage, duration)
+}
+
+func (c *CommandCenter) rejectTempBasal(code byte, reason string) {
+	fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting temp basal, " + reason + " - Data: " + base64.StdEncoding.EncodeToString([]byte{ERROR_CODE_COMMAND}))
+	c.encodeAndWrite(code, []byte{ERROR_CODE_COMMAND})
+}
+
+func (c *CommandCenter) startTempBasal(code byte, percentage int, duration time.Duration) {
+	// Deliver the basal up till now on the old rate & replace the running temp basal
+	c.updateBasalDelivery()
+	if c.state.TempBasalActiveTill != nil {
+		c.stopTempBasal(c.clock.Now())
+	}
+
+	var startedAt = c.clock.Now()
+	var activeTill = startedAt.Add(duration)
 	c.state.TempBasalPercentage = percentage
+	c.state.TempBasalStartedAt = &startedAt
 	c.state.TempBasalActiveTill = &activeTill
+	c.state.IsApsTempBasal = code == OPCODE_BASAL__APS_SET_TEMPORARY_BASAL
 	c.state.Save()
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Setting temp basal - percentage: " + fmt.Sprint(percentage) + "%, duration: " + fmt.Sprint(duration))
 	c.encodeAndWrite(code, []byte{0x00})
 }
 
+func (c *CommandCenter) respondToTempBasalState() {
+	c.updateBasalDelivery()
+
+	var message = make([]byte, 8)
+	if c.state.TempBasalActiveTill != nil {
+		var now = c.clock.Now()
+		var startedAt = c.tempBasalStartedAt()
+		var runningInMinutes = int(now.Sub(startedAt).Minutes())
+		var remainingInMinutes = int(math.Ceil(c.state.TempBasalActiveTill.Sub(now).Minutes()))
+
+		// In progress, 0x02 for an APS temp basal
+		message[1] = 0x01
+		if c.state.IsApsTempBasal {
+			message[1] = 0x02
+		}
+		message[2] = encodeTempBasalPercentage(c.state.TempBasalPercentage)
+		message[3] = encodeTempBasalDuration(c.state.TempBasalActiveTill.Sub(startedAt))
+		message[4] = byte(runningInMinutes)
+		message[5] = byte(runningInMinutes >> 8)
+		message[6] = byte(remainingInMinutes)
+		message[7] = byte(remainingInMinutes >> 8)
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BASAL__TEMPORARY_BASAL_STATE - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BASAL__TEMPORARY_BASAL_STATE, message)
+}
+
 func (c *CommandCenter) respondToBasalGetRate() {
+	var maxBasal = c.state.MaxBasal * 100
 	var message = []byte{
 		// Max basal
-		byte(c.state.MaxBasal * 100), byte((c.state.MaxBasal * 100) >> 8),
-		// Basal step
-		1,
-		// Basal rate
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
-		0, 0,
+		byte(maxBasal), byte(maxBasal >> 8),
+		// Basal step, in 0.01U/hr
+		BASAL_STEP,
 	}
+	// Basal rate of the active profile
+	message = append(message, encodeHourlyBasalRates(c.state.ActiveBasalSchedule())...)
 
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Get basal rate - Data: " + base64.StdEncoding.EncodeToString(message))
 	c.encodeAndWrite(OPCODE_BASAL__GET_BASAL_RATE, message)
 }
 
+func (c *CommandCenter) respondToBasalSetRate(request []byte) {
+	if len(request) < 2+24*2 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Basal rate too short - Data: " + base64.StdEncoding.EncodeToString([]byte{0x01}))
+		c.encodeAndWrite(OPCODE_BASAL__SET_BASAL_RATE, []byte{0x01})
+		return
+	}
+
+	var schedule = decodeHourlyBasalRates(request[2:])
+	if errorCode := c.checkBasalRates(schedule); errorCode != ERROR_CODE_NONE {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting basal rate - Data: " + base64.StdEncoding.EncodeToString([]byte{errorCode}))
+		c.encodeAndWrite(OPCODE_BASAL__SET_BASAL_RATE, []byte{errorCode})
+		return
+	}
+
+	c.state.BasalProfiles[c.state.ActiveBasalProfile] = schedule
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BASAL__SET_BASAL_RATE - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE_BASAL__SET_BASAL_RATE, []byte{0x00})
+}
+
 func (c *CommandCenter) respondToBolusStepInformation() {
+	var maxBolus = int(math.Round(float64(c.state.MaxBolus) * 100))
 	var message = []byte{
 		// Bolus type
 		0, 0,
@@ -531,27 +826,292 @@ func (c *CommandCenter) respondToBolusStepInformation() {
 		// last bolus amount
 		0, 0,
 		// Max bolus
-		byte(c.state.MaxBolus * 100), byte((c.state.MaxBolus * 100) >> 8),
+		byte(maxBolus), byte(maxBolus >> 8),
 		// Bolus step
-		0,
+		byte(math.Round(float64(c.state.BolusStep) * 100)),
 	}
 	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Get bolus step rate - Data: " + base64.StdEncoding.EncodeToString(message))
 	c.encodeAndWrite(OPCODE_BOLUS__GET_STEP_BOLUS_INFORMATION, message)
 }
 
+func (c *CommandCenter) respondToExtendedBolusStart(request []byte) {
+	if len(request) < 5 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting extended bolus, request too short - Data: " + base64.StdEncoding.EncodeToString([]byte{ERROR_CODE_COMMAND}))
+		c.encodeAndWrite(OPCODE_BOLUS__SET_EXTENDED_BOLUS, []byte{ERROR_CODE_COMMAND})
+		return
+	}
+
+	var amount = float32(int(request[2])|(int(request[3])<<8)) / 100
+	var durationInHalfHours = int(request[4])
+
+	if errorCode := c.checkExtendedBolus(amount, amount, durationInHalfHours); errorCode != ERROR_CODE_NONE {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting extended bolus - Data: " + base64.StdEncoding.EncodeToString([]byte{errorCode}))
+		c.encodeAndWrite(OPCODE_BOLUS__SET_EXTENDED_BOLUS, []byte{errorCode})
+		return
+	}
+
+	c.startExtendedBolus(amount, durationInHalfHours, false)
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_EXTENDED_BOLUS - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE_BOLUS__SET_EXTENDED_BOLUS, []byte{0x00})
+}
+
+func (c *CommandCenter) respondToDualBolusStart(request []byte) {
+	if len(request) < 7 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting dual bolus, request too short - Data: " + base64.StdEncoding.EncodeToString([]byte{ERROR_CODE_COMMAND}))
+		c.encodeAndWrite(OPCODE_BOLUS__SET_DUAL_BOLUS, []byte{ERROR_CODE_COMMAND})
+		return
+	}
+
+	var immediateAmount = float32(int(request[2])|(int(request[3])<<8)) / 100
+	var extendedAmount = float32(int(request[4])|(int(request[5])<<8)) / 100
+	var durationInHalfHours = int(request[6])
+
+	// Both parts together count as a single bolus
+	var errorCode = c.checkExtendedBolus(immediateAmount+extendedAmount, extendedAmount, durationInHalfHours)
+	if errorCode == ERROR_CODE_NONE && c.bolusTicker != nil {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Bolus is already running")
+		errorCode = ERROR_CODE_BOLUS_TIMEOUT
+	}
+	if errorCode == ERROR_CODE_NONE && immediateAmount <= 0 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Invalid immediate amount: " + fmt.Sprint(immediateAmount) + "U")
+		errorCode = ERROR_CODE_COMMAND
+	}
+
+	if errorCode != ERROR_CODE_NONE {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting dual bolus - Data: " + base64.StdEncoding.EncodeToString([]byte{errorCode}))
+		c.encodeAndWrite(OPCODE_BOLUS__SET_DUAL_BOLUS, []byte{errorCode})
+		return
+	}
+
+	c.startExtendedBolus(extendedAmount, durationInHalfHours, true)
+	c.state.DualBolusImmediateAmount = immediateAmount
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_DUAL_BOLUS - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE_BOLUS__SET_DUAL_BOLUS, []byte{0x00})
+
+	c.doBolus(immediateAmount, 0, BOLUS_TYPE_DUAL_STEP)
+}
+
+// checkBolus runs the safety checks of the pump on a new bolus. Returns the error code to reject the bolus with
+func (c *CommandCenter) checkBolus(amount float32) byte {
+	if c.state.IsSuspended {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Pump is suspended")
+		return ERROR_CODE_PUMP_SUSPENDED
+	}
+
+	if c.state.BatteryCharge <= 0 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Battery is empty")
+		return ERROR_CODE_PUMP_SUSPENDED
+	}
+
+	if c.state.IsPrimeRequired {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Pump hasnt been primed after the refill")
+		return ERROR_CODE_PUMP_SUSPENDED
+	}
+
+	if c.isDeliveryBlocked() {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Pump is blocked by alarm: " + Alarms[c.state.ActiveAlarm].Name)
+		return ERROR_CODE_PUMP_SUSPENDED
+	}
+
+	if amount <= 0 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Invalid bolus amount: " + fmt.Sprint(amount) + "U")
+		return ERROR_CODE_COMMAND
+	}
+
+	if !c.isBolusStep(amount) {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Bolus of " + fmt.Sprint(amount) + "U is not a multiple of the bolus step of " + fmt.Sprint(c.state.BolusStep) + "U")
+		return ERROR_CODE_COMMAND
+	}
+
+	if amount > c.state.ReservoirLevel {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Bolus of " + fmt.Sprint(amount) + "U exceeds the reservoir level of " + fmt.Sprint(c.state.ReservoirLevel) + "U")
+		return ERROR_CODE_INSULIN_LIMIT_VIOLATION
+	}
+
+	if amount > c.state.MaxBolus {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Bolus of " + fmt.Sprint(amount) + "U exceeds the max bolus of " + fmt.Sprint(c.state.MaxBolus) + "U")
+		return ERROR_CODE_MAX_BOLUS_VIOLATION
+	}
+
+	// The running extended bolus is only added to the daily total once it has finished, but it is already committed
+	c.updateBasalDelivery()
+	var dailyTotal = c.state.TodayBasalDelivered + c.state.TodayBolusDelivered + c.state.ExtendedBolusAmount
+	if dailyTotal+amount > float32(c.state.MaxDailyTotal) {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Bolus of " + fmt.Sprint(amount) + "U exceeds the max daily total of " + fmt.Sprint(c.state.MaxDailyTotal) + "U, already given today: " + fmt.Sprint(dailyTotal) + "U")
+		return ERROR_CODE_INSULIN_LIMIT_VIOLATION
+	}
+
+	return ERROR_CODE_NONE
+}
+
+// checkExtendedBolus runs the safety checks on a new extended (or dual) bolus, where the amount is the full bolus.
+// Returns the error code to reject the bolus with
+func (c *CommandCenter) checkExtendedBolus(amount float32, extendedAmount float32, durationInHalfHours int) byte {
+	if errorCode := c.checkBolus(amount); errorCode != ERROR_CODE_NONE {
+		return errorCode
+	}
+
+	if !c.state.IsExtendedBolusEnabled {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Extended bolus is disabled in the bolus options")
+		return ERROR_CODE_COMMAND
+	}
+
+	if c.state.ExtendedBolusActiveTill != nil {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Extended bolus is already running")
+		return ERROR_CODE_BOLUS_TIMEOUT
+	}
+
+	// Extended bolus can be given for 30 min up to 8 hours
+	if extendedAmount <= 0 || durationInHalfHours < 1 || durationInHalfHours > 16 {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Invalid extended bolus, amount: " + fmt.Sprint(extendedAmount) + "U, duration: " + fmt.Sprint(durationInHalfHours) + " half hours")
+		return ERROR_CODE_COMMAND
+	}
+
+	return ERROR_CODE_NONE
+}
+
+// checkBasalRates rejects any basal rate above the max basal. Returns the error code to reject the rates with
+func (c *CommandCenter) checkBasalRates(schedule []float32) byte {
+	for i, rate := range schedule {
+		if rate > float32(c.state.MaxBasal) {
+			fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Basal rate of " + fmt.Sprint(rate) + "U/hr at " + fmt.Sprint(i/2) + "h exceeds the max basal of " + fmt.Sprint(c.state.MaxBasal) + "U/hr")
+			return ERROR_CODE_INSULIN_LIMIT_VIOLATION
+		}
+	}
+
+	return ERROR_CODE_NONE
+}
+
+func (c *CommandCenter) startExtendedBolus(amount float32, durationInHalfHours int, isDualBolus bool) {
+	var now = c.clock.Now()
+	var activeTill = now.Add(time.Duration(durationInHalfHours) * 30 * time.Minute)
+	c.state.ExtendedBolusStartedAt = &now
+	c.state.ExtendedBolusActiveTill = &activeTill
+	c.state.ExtendedBolusAmount = amount
+	c.state.ExtendedBolusDelivered = 0
+	c.state.IsDualBolus = isDualBolus
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Starting extended bolus - amount: " + fmt.Sprint(amount) + "U, duration: " + fmt.Sprint(activeTill.Sub(now)) + ", dual: " + fmt.Sprint(isDualBolus))
+	c.startExtendedBolusTicker()
+}
+
+func (c *CommandCenter) respondToExtendedBolusCancel() {
+	if c.state.ExtendedBolusActiveTill == nil {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: No active extended bolus, nothing to cancel - Data: " + base64.StdEncoding.EncodeToString([]byte{0x01}))
+		c.encodeAndWrite(OPCODE_BOLUS__SET_EXTENDED_BOLUS_CANCEL, []byte{0x01})
+		return
+	}
+
+	c.stopExtendedBolus()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_EXTENDED_BOLUS_CANCEL - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE_BOLUS__SET_EXTENDED_BOLUS_CANCEL, []byte{0x00})
+}
+
+func (c *CommandCenter) respondToExtendedBolusState() {
+	var message = make([]byte, 9)
+
+	// error
+	message[0] = 0
+
+	if c.state.ExtendedBolusActiveTill != nil {
+		var duration = c.state.ExtendedBolusActiveTill.Sub(*c.state.ExtendedBolusStartedAt)
+		var absoluteRate = int(c.state.ExtendedBolusAmount / float32(duration.Hours()) * 100)
+		var soFarInMinutes = int(c.clock.Now().Sub(*c.state.ExtendedBolusStartedAt).Minutes())
+		var deliveredSoFar = int(c.state.ExtendedBolusDelivered * 100)
+
+		message[1] = 1 // isExtendedInProgress
+		message[2] = byte(duration / (30 * time.Minute))
+		message[3] = byte(absoluteRate)
+		message[4] = byte(absoluteRate >> 8)
+		message[5] = byte(soFarInMinutes)
+		message[6] = byte(soFarInMinutes >> 8)
+		message[7] = byte(deliveredSoFar)
+		message[8] = byte(deliveredSoFar >> 8)
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__GET_EXTENDED_BOLUS_STATE - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BOLUS__GET_EXTENDED_BOLUS_STATE, message)
+}
+
+func (c *CommandCenter) respondToGetExtendedBolus() {
+	var message = make([]byte, 4)
+
+	// error
+	message[0] = 0
+
+	if c.state.ExtendedBolusActiveTill != nil {
+		var amount = int(c.state.ExtendedBolusAmount * 100)
+		var duration = c.state.ExtendedBolusActiveTill.Sub(*c.state.ExtendedBolusStartedAt)
+
+		// Extended bolus amount
+		message[1] = byte(amount)
+		message[2] = byte(amount >> 8)
+
+		// Extended bolus duration (half hours)
+		message[3] = byte(duration / (30 * time.Minute))
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__GET_EXTENDED_BOLUS - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BOLUS__GET_EXTENDED_BOLUS, message)
+}
+
+// respondToGetDualBolus follows the layout AAPS parses in DanaRSPacketBolusGetDualBolus: the bolus step, the absolute
+// rate of the extended part, the max bolus & the bolus increment
+func (c *CommandCenter) respondToGetDualBolus() {
+	var bolusStep = int(math.Round(float64(c.state.BolusStep) * 100))
+	var maxBolus = int(math.Round(float64(c.state.MaxBolus) * 100))
+
+	var absoluteRate = 0
+	if c.state.ExtendedBolusActiveTill != nil && c.state.IsDualBolus {
+		var duration = c.state.ExtendedBolusActiveTill.Sub(*c.state.ExtendedBolusStartedAt)
+		absoluteRate = int(math.Round(float64(c.state.ExtendedBolusAmount) / duration.Hours() * 100))
+	}
+
+	var message = []byte{
+		// error
+		0x00,
+		byte(bolusStep), byte(bolusStep >> 8),
+		byte(absoluteRate), byte(absoluteRate >> 8),
+		byte(maxBolus), byte(maxBolus >> 8),
+		// Bolus increment
+		byte(bolusStep),
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__GET_DUAL_BOLUS - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_BOLUS__GET_DUAL_BOLUS, message)
+}
+
 func (c *CommandCenter) encodeAndWrite(code byte, message []byte) {
 	var data = c.encryption.Encryption(EncryptionParams{operationCode: code, data: message, isEncryptionCommand: false})
 	data = c.encryption.EncryptionSecondLvl(data)
 	c.write(data)
 }
 
+// encodeAndNotify sends a notification to the connected phone. Without a phone the notification is dropped, as every
+// encrypted packet moves the sync key of the DanaRS-v3 on. Alarms can still be read from the history
+func (c *CommandCenter) encodeAndNotify(code byte, message []byte) {
+	if !c.isPhoneConnected {
+		fmt.Println(time.Now().Format(time.RFC3339) + " WARNING: No phone connected, dropping notification " + fmt.Sprint(code) + " - Data: " + base64.StdEncoding.EncodeToString(message))
+		return
+	}
+
+	var data = c.encryption.Encryption(EncryptionParams{operationCode: code, data: message, isNotifyCommand: true, isEncryptionCommand: false})
+	data = c.encryption.EncryptionSecondLvl(data)
+	c.write(data)
+}
+
 func (c *CommandCenter) write(data []byte) {
 	var index = 0
 	for index < len(data) {
 		var length = int(math.Min(20, float64(len(data)-index)))
 		var subData = data[index : index+length]
 
-		var _, err = c.writeCharacteristic.Write(subData)
+		var err = c.transport.Write(subData)
 		if err != nil {
 			fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: failed to write data: " + err.Error())
 			return
@@ -561,63 +1121,238 @@ func (c *CommandCenter) write(data []byte) {
 	}
 }
 
-func (c *CommandCenter) doBolus(amount float32, speed byte) {
+func (c *CommandCenter) doBolus(amount float32, speed byte, bolusType byte) {
 	var send = func(code byte, currentAmount int) {
 		var message = make([]byte, 2)
 
 		message[0] = byte(currentAmount)
 		message[1] = byte(currentAmount >> 8)
 
-		var data = c.encryption.Encryption(EncryptionParams{operationCode: code, data: message, isNotifyCommand: true, isEncryptionCommand: false})
-		data = c.encryption.EncryptionSecondLvl(data)
-
 		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_BOLUS__SET_STEP_BOLUS_START - Data: " + base64.StdEncoding.EncodeToString(message))
-		c.write(data)
+		c.encodeAndNotify(code, message)
 	}
 
 	var timePerTick = 500 * time.Millisecond
-	c.bolusTicker = time.NewTicker(timePerTick)
+	var ticker = c.clock.NewTicker(timePerTick)
+	c.bolusTicker = ticker
+	c.bolusType = bolusType
+	c.currentAmount = 0
+	c.bolusStartedAt = c.clock.Now()
+	var startedAt = c.bolusStartedAt
+	var fullDuration = getFullDuration(amount, speed)
 	go func() {
-		var fullDuration = getFullDuration(amount, speed)
-		var bolusIndex float32 = 0
-		var totalTicks = float32(fullDuration / timePerTick)
+		for range ticker.C() {
+			c.mutex.Lock()
+			if c.bolusTicker != ticker {
+				// Bolus has been cancelled in the meantime
+				c.mutex.Unlock()
+				ticker.Handled()
+				return
+			}
 
-		for range c.bolusTicker.C {
-			c.currentAmount = bolusIndex / totalTicks * amount
-			if c.currentAmount >= amount {
-				c.state.ReservoirLevel -= amount
-				send(OPCODE_NOTIFY__DELIVERY_COMPLETE, int(amount*100))
-				c.storeBolus(amount)
+			// The progress follows the clock, so a late tick catches up instead of slowing down the bolus
+			var amountSoFar = amount
+			if fullDuration > 0 {
+				amountSoFar = min(float32(c.clock.Now().Sub(startedAt))/float32(fullDuration)*amount, amount)
+			}
+			if !c.isDeliveryBlocked() {
+				c.currentAmount += c.takeFromReservoir(amountSoFar - c.currentAmount)
+			}
+			if c.currentAmount >= amount || c.isDeliveryBlocked() {
+				// Either done, or an alarm (like an empty reservoir) stopped the bolus halfway
+				send(OPCODE_NOTIFY__DELIVERY_COMPLETE, int(c.currentAmount*100))
+				c.storeBolus(c.bolusStartedAt, c.currentAmount, c.bolusType, 0)
 
 				c.bolusTicker.Stop()
 				c.bolusTicker = nil
 			}
 
 			send(OPCODE_NOTIFY__DELIVERY_RATE_DISPLAY, int(c.currentAmount*100))
-			bolusIndex += 1
+			c.mutex.Unlock()
+			ticker.Handled()
 		}
 	}()
 }
 
-func (c *CommandCenter) storeBolus(amount float32) {
+// startExtendedBolusTicker delivers the running extended bolus, based on the elapsed time since the start
+func (c *CommandCenter) startExtendedBolusTicker() {
+	var ticker = c.clock.NewTicker(5 * time.Second)
+	c.extendedBolusTicker = ticker
+
+	go func() {
+		for range ticker.C() {
+			c.mutex.Lock()
+			if c.extendedBolusTicker != ticker {
+				// Extended bolus has been stopped in the meantime
+				c.mutex.Unlock()
+				ticker.Handled()
+				return
+			}
+
+			c.deliverExtendedBolus()
+			c.mutex.Unlock()
+			ticker.Handled()
+		}
+	}()
+}
+
+func (c *CommandCenter) deliverExtendedBolus() {
+	if c.updateExtendedBolusDelivery() {
+		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Extended bolus completed - amount: " + fmt.Sprint(c.state.ExtendedBolusDelivered) + "U")
+		c.stopExtendedBolus()
+	}
+}
+
+// updateExtendedBolusDelivery delivers the extended bolus up till now. Returns true when the extended bolus is completed
+func (c *CommandCenter) updateExtendedBolusDelivery() bool {
+	var now = c.clock.Now()
+	if now.After(*c.state.ExtendedBolusActiveTill) {
+		now = *c.state.ExtendedBolusActiveTill
+	}
+
+	var duration = c.state.ExtendedBolusActiveTill.Sub(*c.state.ExtendedBolusStartedAt)
+	var progress = float32(now.Sub(*c.state.ExtendedBolusStartedAt)) / float32(duration)
+	var delivered = c.state.ExtendedBolusAmount * progress
+
+	if !c.isDeliveryBlocked() {
+		c.state.ExtendedBolusDelivered += c.takeFromReservoir(delivered - c.state.ExtendedBolusDelivered)
+	}
+
+	// An alarm (like an empty reservoir) ends the extended bolus as well
+	return now.Equal(*c.state.ExtendedBolusActiveTill) || c.isDeliveryBlocked()
+}
+
+// stopExtendedBolus stops the extended bolus and stores the delivered amount in the history
+func (c *CommandCenter) stopExtendedBolus() {
+	c.updateExtendedBolusDelivery()
+
+	if c.extendedBolusTicker != nil {
+		c.extendedBolusTicker.Stop()
+		c.extendedBolusTicker = nil
+	}
+
+	var startedAt = *c.state.ExtendedBolusStartedAt
+	var delivered = c.state.ExtendedBolusDelivered
+	var duration = c.clock.Now().Sub(startedAt)
+	if c.clock.Now().After(*c.state.ExtendedBolusActiveTill) {
+		duration = c.state.ExtendedBolusActiveTill.Sub(startedAt)
+	}
+
+	var bolusType = BOLUS_TYPE_EXTENDED
+	if c.state.IsDualBolus {
+		bolusType = BOLUS_TYPE_DUAL_EXTENDED
+	}
+
+	c.state.ExtendedBolusStartedAt = nil
+	c.state.ExtendedBolusActiveTill = nil
+	c.state.ExtendedBolusAmount = 0
+	c.state.ExtendedBolusDelivered = 0
+	c.state.IsDualBolus = false
+	c.state.DualBolusImmediateAmount = 0
+
+	c.storeBolus(startedAt, delivered, bolusType, duration)
+}
+
+func (c *CommandCenter) storeBolus(timestamp time.Time, amount float32, bolusType byte, duration time.Duration) {
+	// Make sure a bolus right after midnight doesnt end up in the total of yesterday
+	c.updateBasalDelivery()
+	c.state.TodayBolusDelivered += amount
+
+	var minutes = int(duration.Minutes())
 	var historyItem = HistoryItem{
-		timestamp: time.Now(),
-		code:      HISTORYBOLUS,
-		value:     uint16(amount * 100),
-		// param7 & param8 is used for duration and bolusType. UNIMPLEMENTED
-		param7: 0,
-		param8: 0,
+		Timestamp: timestamp,
+		Code:      HISTORYBOLUS,
+		Value:     uint16(amount * 100),
+		// Param7 holds the minutes of the duration & Param8 the bolus type together with the hours of the duration
+		Param7: byte(minutes % 60),
+		Param8: bolusType | byte(minutes/60),
 	}
 
 	c.state.History = append(c.state.History, historyItem)
 	c.state.Save()
 }
 
+// stopTempBasal ends the running temp basal at the given time & stores it in the history
+func (c *CommandCenter) stopTempBasal(endedAt time.Time) {
+	var startedAt = c.tempBasalStartedAt()
+	var minutes = int(endedAt.Sub(startedAt).Minutes())
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Temp basal ended - percentage: " + fmt.Sprint(c.state.TempBasalPercentage) + "%, duration: " + fmt.Sprint(endedAt.Sub(startedAt)))
+	c.state.History = append(c.state.History, HistoryItem{
+		Timestamp: startedAt,
+		Code:      HISTORY_TEMP_BASAL,
+		Value:     uint16(c.state.TempBasalPercentage),
+		// Param7 holds the minutes of the duration & Param8 the hours of the duration
+		Param7: byte(minutes % 60),
+		Param8: byte(minutes / 60),
+	})
+
+	c.state.TempBasalPercentage = 100
+	c.state.TempBasalStartedAt = nil
+	c.state.TempBasalActiveTill = nil
+	c.state.IsApsTempBasal = false
+	c.state.Save()
+}
+
+// tempBasalStartedAt returns the start of the running temp basal. State files from before the start was stored, are
+// assumed to have started right away
+func (c *CommandCenter) tempBasalStartedAt() time.Time {
+	if c.state.TempBasalStartedAt == nil {
+		return c.clock.Now()
+	}
+
+	return *c.state.TempBasalStartedAt
+}
+
+// currentBasal returns the basal rate which is delivered right now, including the running temp basal
 func (c *CommandCenter) currentBasal() float32 {
-	var currentTime = time.Now()
-	var pastHalfHours int = (currentTime.Hour() * 2) + int(currentTime.Minute()/30)
+	return c.basalRateAt(c.clock.Now())
+}
+
+// encodeTempBasalPercentage fits the percentage into a single byte, percentages above 200% are stored in steps of 10%
+func encodeTempBasalPercentage(percentage int) byte {
+	if percentage > 200 {
+		return byte(200 + (percentage-200)/10)
+	}
+
+	return byte(percentage)
+}
+
+// encodeTempBasalDuration returns the duration code of a temp basal: 150 for 15 min, 160 for 30 min or else the hours
+func encodeTempBasalDuration(duration time.Duration) byte {
+	switch duration {
+	case 15 * time.Minute:
+		return 150
+	case 30 * time.Minute:
+		return 160
+	}
+
+	return byte(duration.Round(time.Hour) / time.Hour)
+}
+
+// encodeHourlyBasalRates converts the 48 half-hour slots into the 24 hourly rates (2 bytes LE, in 0.01U/hr) the pump reports
+func encodeHourlyBasalRates(schedule []float32) []byte {
+	var message = make([]byte, 24*2)
+	for hour := 0; hour < 24; hour++ {
+		// A Dana pump only knows hourly rates, so use the average of both half hours
+		var rate = int(math.Round(float64((schedule[hour*2]+schedule[hour*2+1])/2) * 100))
+		message[hour*2] = byte(rate)
+		message[hour*2+1] = byte(rate >> 8)
+	}
+
+	return message
+}
+
+// decodeHourlyBasalRates converts the 24 hourly rates (2 bytes LE, in 0.01U/hr) into 48 half-hour slots
+func decodeHourlyBasalRates(data []byte) []float32 {
+	var schedule = make([]float32, BASAL_SLOTS_PER_PROFILE)
+	for hour := 0; hour < 24; hour++ {
+		var rate = float32(int(data[hour*2])+(int(data[hour*2+1])<<8)) / 100
+		schedule[hour*2] = rate
+		schedule[hour*2+1] = rate
+	}
 
-	return c.state.BasalSchedule[pastHalfHours]
+	return schedule
 }
 
 func getFullDuration(amount float32, speed byte) time.Duration {
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRejectShortBolusRequests(t *testing.T) {
+	var tests = []struct {
+		name    string
+		code    byte
+		request []byte
+	}{
+		{"bolus without speed", OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{0x64, 0x00}},
+		{"bolus without amount", OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{}},
+		{"extended bolus without duration", OPCODE_BOLUS__SET_EXTENDED_BOLUS, []byte{0x64, 0x00}},
+		{"dual bolus without duration", OPCODE_BOLUS__SET_DUAL_BOLUS, []byte{0x64, 0x00, 0x64, 0x00}},
+	}
+
+	var simulator, client, _ = startLoopback(t, PUMP_TYPE_DANA_I)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response, err = client.Command(test.code, test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(response, []byte{ERROR_CODE_COMMAND}) {
+				t.Errorf("expected %v, got %v", []byte{ERROR_CODE_COMMAND}, response)
+			}
+			if simulator.State.ReservoirLevel != RESERVOIR_CAPACITY {
+				t.Errorf("expected nothing to be delivered, reservoir level: %vU", simulator.State.ReservoirLevel)
+			}
+		})
+	}
+}
+
+func TestGetDualBolus(t *testing.T) {
+	var simulator, client, _ = startLoopback(t, PUMP_TYPE_DANA_I)
+
+	// error, bolus step (0.05U), extended rate, max bolus (10U) & bolus increment, all times 100
+	var expected = []byte{0x00, 0x05, 0x00, 0x00, 0x00, 0xe8, 0x03, 0x05}
+	var response, err = client.Command(OPCODE_BOLUS__GET_DUAL_BOLUS, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, expected) {
+		t.Errorf("without dual bolus: expected %v, got %v", expected, response)
+	}
+
+	if err := client.DualBolus(1, 1.5, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// The extended 1.5U over an hour
+	expected = []byte{0x00, 0x05, 0x00, 0x96, 0x00, 0xe8, 0x03, 0x05}
+	response, err = client.Command(OPCODE_BOLUS__GET_DUAL_BOLUS, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, expected) {
+		t.Errorf("with dual bolus: expected %v, got %v", expected, response)
+	}
+
+	if !simulator.State.IsDualBolus {
+		t.Error("expected a dual bolus to be running")
+	}
+}
+
+func TestInitialScreenAfterTempBasalExpiry(t *testing.T) {
+	var state = NewState()
+	state.BasalProfiles[state.ActiveBasalProfile] = make([]float32, BASAL_SLOTS_PER_PROFILE)
+
+	var _, client, clock = startLoopbackWithState(t, state)
+
+	// Start off the 10s delivery ticks, so the temp basal expires in between two of them
+	clock.Advance(5 * time.Second)
+	if err := client.SetApsTempBasal(150, 15*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(15*time.Minute + time.Second)
+
+	// No status flags, nothing delivered, max daily total 250U, reservoir 300U, no basal, temp basal 100%, battery 100%,
+	// no extended bolus, no insulin on board & no error state
+	var expected = []byte{0x00, 0x00, 0x00, 0xa8, 0x61, 0x30, 0x75, 0x00, 0x00, 0x64, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00}
+	var response, err = client.Command(OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, expected) {
+		t.Errorf("expected %v, got %v", expected, response)
+	}
+}
+
+func TestInitialScreenTempBasalPercentage(t *testing.T) {
+	var tests = []struct {
+		percentage int
+		expected   byte
+	}{
+		{50, 50},
+		{200, 200},
+		// Above 200% the pump counts in steps of 10%
+		{260, 206},
+		{500, 230},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.percentage), func(t *testing.T) {
+			var state = NewState()
+			state.BasalProfiles[state.ActiveBasalProfile] = make([]float32, BASAL_SLOTS_PER_PROFILE)
+
+			var _, client, _ = startLoopbackWithState(t, state)
+			// Above 200% only 15 minutes are allowed
+			if err := client.SetApsTempBasal(test.percentage, 15*time.Minute); err != nil {
+				t.Fatal(err)
+			}
+
+			var expected = []byte{0x10, 0x00, 0x00, 0xa8, 0x61, 0x30, 0x75, 0x00, 0x00, test.expected, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00}
+			var response, err = client.Command(OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, []byte{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(response, expected) {
+				t.Errorf("expected %v, got %v", expected, response)
+			}
+		})
+	}
+}
+
+// hourlyRates encodes the rates of 12 & 12 hours the way AAPS sends a basal profile (2 bytes LE, in 0.01U/hr)
+func hourlyRates(first []byte, second []byte) []byte {
+	return append(bytes.Repeat(first, 12), bytes.Repeat(second, 12)...)
+}
+
+func TestBasalProfiles(t *testing.T) {
+	var _, client, _ = startLoopback(t, PUMP_TYPE_DANA_I)
+
+	// 0.5U/hr in the first half of the day & 1.25U/hr in the second half
+	var profile = hourlyRates([]byte{0x32, 0x00}, []byte{0x7d, 0x00})
+
+	runCommandTests(t, client, []commandTest{
+		{"active profile", OPCODE_BASAL__GET_PROFILE_NUMBER, []byte{}, []byte{0x00}},
+		{"untouched profile", OPCODE_BASAL__GET_PROFILE_BASAL_RATE, []byte{0x02}, hourlyRates([]byte{0x64, 0x00}, []byte{0x64, 0x00})},
+		{"set profile", OPCODE_BASAL__SET_PROFILE_BASAL_RATE, append([]byte{0x02}, profile...), []byte{0x00}},
+		{"get profile", OPCODE_BASAL__GET_PROFILE_BASAL_RATE, []byte{0x02}, profile},
+		{"other profile is untouched", OPCODE_BASAL__GET_PROFILE_BASAL_RATE, []byte{0x01}, hourlyRates([]byte{0x64, 0x00}, []byte{0x64, 0x00})},
+		{"switch profile", OPCODE_BASAL__SET_PROFILE_NUMBER, []byte{0x02}, []byte{0x00}},
+		{"switched profile", OPCODE_BASAL__GET_PROFILE_NUMBER, []byte{}, []byte{0x02}},
+		{"switch to unknown profile", OPCODE_BASAL__SET_PROFILE_NUMBER, []byte{0x04}, []byte{0x01}},
+		{"set unknown profile", OPCODE_BASAL__SET_PROFILE_BASAL_RATE, append([]byte{0x04}, profile...), []byte{0x01}},
+		{"set profile above max basal", OPCODE_BASAL__SET_PROFILE_BASAL_RATE, append([]byte{0x01}, hourlyRates([]byte{0x64, 0x00}, []byte{0x2d, 0x01})...), []byte{ERROR_CODE_INSULIN_LIMIT_VIOLATION}},
+		{"still on the switched profile", OPCODE_BASAL__GET_PROFILE_NUMBER, []byte{}, []byte{0x02}},
+	})
+}
+
+func TestBasalRate(t *testing.T) {
+	var _, client, _ = startLoopback(t, PUMP_TYPE_DANA_I)
+
+	// Max basal (3U/hr) & basal step (0.01U/hr), followed by the rates of the active profile
+	var header = []byte{0x2c, 0x01, 0x01}
+	var rates = hourlyRates([]byte{0x32, 0x00}, []byte{0x7d, 0x00})
+
+	runCommandTests(t, client, []commandTest{
+		{"default rate", OPCODE_BASAL__GET_BASAL_RATE, []byte{}, append(header, hourlyRates([]byte{0x64, 0x00}, []byte{0x64, 0x00})...)},
+		{"set rate", OPCODE_BASAL__SET_BASAL_RATE, rates, []byte{0x00}},
+		{"get rate", OPCODE_BASAL__GET_BASAL_RATE, []byte{}, append(header, rates...)},
+		{"set rate too short", OPCODE_BASAL__SET_BASAL_RATE, rates[:46], []byte{0x01}},
+		{"set rate above max basal", OPCODE_BASAL__SET_BASAL_RATE, hourlyRates([]byte{0x2d, 0x01}, []byte{0x64, 0x00}), []byte{ERROR_CODE_INSULIN_LIMIT_VIOLATION}},
+		// The rate of the active profile is set
+		{"active profile", OPCODE_BASAL__GET_PROFILE_BASAL_RATE, []byte{0x00}, rates},
+	})
+}
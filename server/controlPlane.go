@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ControlPlane is a small HTTP api to act on the pump from the outside, like a user confirming an alarm on the pump
+// or a pump failure, so these situations can be tested without touching the state.json
+type ControlPlane struct {
+	simulator *Simulator
+	mux       *http.ServeMux
+}
+
+func NewControlPlane(simulator *Simulator) *ControlPlane {
+	var p = &ControlPlane{
+		simulator: simulator,
+		mux:       http.NewServeMux(),
+	}
+
+	p.mux.HandleFunc("GET /api/state", p.getState)
+	p.mux.HandleFunc("POST /api/alarms/{name}", p.raiseAlarm)
+	p.mux.HandleFunc("DELETE /api/alarms", p.clearAlarm)
+	p.mux.HandleFunc("POST /api/battery", p.replaceBattery)
+	p.mux.HandleFunc("POST /api/refill", p.refill)
+	p.mux.HandleFunc("POST /api/prime/tube", p.primeTube)
+	p.mux.HandleFunc("POST /api/prime/cannula", p.primeCannula)
+
+	return p
+}
+
+func (p *ControlPlane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+func (p *ControlPlane) getState(w http.ResponseWriter, r *http.Request) {
+	p.simulator.commandCenter.mutex.Lock()
+	json, err := json.Marshal(p.simulator.State)
+	p.simulator.commandCenter.mutex.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func (p *ControlPlane) raiseAlarm(w http.ResponseWriter, r *http.Request) {
+	code, ok := FindAlarm(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "unknown alarm: "+r.PathValue("name"), http.StatusNotFound)
+		return
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Control plane raises alarm: " + r.PathValue("name"))
+	p.simulator.RaiseAlarm(code)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *ControlPlane) clearAlarm(w http.ResponseWriter, r *http.Request) {
+	p.simulator.ClearAlarm()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *ControlPlane) replaceBattery(w http.ResponseWriter, r *http.Request) {
+	p.simulator.ReplaceBattery()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refill fills the reservoir with the amount query parameter (in U), or the RefillAmount of the user options
+func (p *ControlPlane) refill(w http.ResponseWriter, r *http.Request) {
+	p.simulator.commandCenter.mutex.Lock()
+	var amount = float32(p.simulator.State.RefillAmount)
+	p.simulator.commandCenter.mutex.Unlock()
+
+	amount, err := parseAmount(r, amount)
+	if err == nil {
+		err = p.simulator.Refill(amount)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// primeTube primes the tube with the amount query parameter (in U), or PRIME_TUBE_AMOUNT
+func (p *ControlPlane) primeTube(w http.ResponseWriter, r *http.Request) {
+	amount, err := parseAmount(r, PRIME_TUBE_AMOUNT)
+	if err == nil {
+		err = p.simulator.PrimeTube(amount)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *ControlPlane) primeCannula(w http.ResponseWriter, r *http.Request) {
+	if err := p.simulator.PrimeCannula(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseAmount reads the amount query parameter, falling back to the given amount when it is missing
+func parseAmount(r *http.Request, fallback float32) (float32, error) {
+	var value = r.URL.Query().Get("amount")
+	if value == "" {
+		return fallback, nil
+	}
+
+	amount, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount: %s", value)
+	}
+
+	return float32(amount), nil
+}
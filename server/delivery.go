@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// startDeliveryTicker runs the basal delivery in the background, for as long as the simulator runs
+func (c *CommandCenter) startDeliveryTicker() {
+	if c.deliveryTicker != nil {
+		c.deliveryTicker.Stop()
+	}
+
+	var ticker = c.clock.NewTicker(10 * time.Second)
+	c.deliveryTicker = ticker
+
+	go func() {
+		for range ticker.C() {
+			c.mutex.Lock()
+			if c.deliveryTicker != ticker {
+				c.mutex.Unlock()
+				ticker.Handled()
+				return
+			}
+
+			c.updateBasalDelivery()
+			c.checkShutdown()
+			c.checkMissedBolus()
+			c.mutex.Unlock()
+			ticker.Handled()
+		}
+	}()
+}
+
+// updateBasalDelivery delivers the basal since the last delivery up till now. The time is split up in half hours (and the
+// end of the temp basal), so every part has a single rate and the hourly & daily history items can be stored on the way
+func (c *CommandCenter) updateBasalDelivery() {
+	var now = c.clock.Now()
+	if c.state.LastDeliveryAt == nil {
+		c.state.LastDeliveryAt = &now
+		return
+	}
+
+	var from = *c.state.LastDeliveryAt
+	var hasChanged = false
+	for from.Before(now) {
+		// Added as a duration, as the wall clock skips or repeats an hour on a DST change
+		var pastHalfHour = time.Duration(from.Minute()%30)*time.Minute + time.Duration(from.Second())*time.Second + time.Duration(from.Nanosecond())
+		var nextHalfHour = from.Add(30*time.Minute - pastHalfHour)
+		var till = nextHalfHour
+		if c.state.TempBasalActiveTill != nil && from.Before(*c.state.TempBasalActiveTill) && till.After(*c.state.TempBasalActiveTill) {
+			till = *c.state.TempBasalActiveTill
+		}
+		if till.After(now) {
+			till = now
+		}
+
+		c.drainBattery(c.state.BatteryDrainPerDay * float32(till.Sub(from).Hours()/24))
+
+		if !c.state.IsSuspended && !c.isDeliveryBlocked() {
+			var amount = c.takeFromReservoir(c.basalRateAt(from) * float32(till.Sub(from).Hours()))
+			c.state.HourBasalDelivered += amount
+			c.state.TodayBasalDelivered += amount
+		}
+
+		if till.Equal(nextHalfHour) && till.Minute() == 0 {
+			c.storeBasalHour(till.Add(-time.Hour))
+			hasChanged = true
+
+			if till.Day() != from.Day() {
+				c.storeDaily(time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location()))
+			}
+		}
+
+		from = till
+	}
+
+	c.state.LastDeliveryAt = &now
+
+	if c.state.TempBasalActiveTill != nil && !now.Before(*c.state.TempBasalActiveTill) {
+		// Saves the state as well
+		c.stopTempBasal(*c.state.TempBasalActiveTill)
+	} else if hasChanged {
+		c.state.Save()
+	}
+}
+
+// takeFromReservoir delivers the amount as far as the reservoir allows, raising the low & empty reservoir alarms on the
+// way. Returns the delivered amount
+func (c *CommandCenter) takeFromReservoir(amount float32) float32 {
+	if amount <= 0 || c.state.ReservoirLevel <= 0 {
+		return 0
+	}
+
+	var delivered = min(amount, c.state.ReservoirLevel)
+	var lowReservoirWarning = float32(c.state.LowReservoirWarning)
+	var wasAboveWarning = c.state.ReservoirLevel >= lowReservoirWarning
+
+	c.state.ReservoirLevel -= delivered
+	c.drainBattery(delivered * c.state.BatteryDrainPerUnit)
+	if wasAboveWarning && c.state.ReservoirLevel < lowReservoirWarning && c.state.ReservoirLevel > 0 {
+		c.raiseAlarm(ALARM_CODE_LOW_RESERVOIR)
+	}
+	if c.state.ReservoirLevel <= 0 {
+		c.state.ReservoirLevel = 0
+		c.raiseAlarm(ALARM_CODE_EMPTY_RESERVOIR)
+	}
+
+	return delivered
+}
+
+// basalRateAt returns the basal rate at the given time, including the running temp basal
+func (c *CommandCenter) basalRateAt(timestamp time.Time) float32 {
+	var pastHalfHours int = (timestamp.Hour() * 2) + int(timestamp.Minute()/30)
+	var rate = c.state.ActiveBasalSchedule()[pastHalfHours]
+
+	if c.state.TempBasalActiveTill != nil && timestamp.Before(*c.state.TempBasalActiveTill) {
+		rate = rate * float32(c.state.TempBasalPercentage) / 100
+	}
+
+	return rate
+}
+
+func (c *CommandCenter) storeBasalHour(timestamp time.Time) {
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Delivered basal - hour: " + timestamp.Format(time.RFC3339) + ", amount: " + fmt.Sprint(c.state.HourBasalDelivered) + "U")
+
+	c.state.History = append(c.state.History, HistoryItem{
+		Timestamp: timestamp,
+		Code:      HISTORY_BASALHOUR,
+		// Rounded, as the basal is summed up from many small parts
+		Value: uint16(math.Round(float64(c.state.HourBasalDelivered) * 100)),
+	})
+	c.state.HourBasalDelivered = 0
+}
+
+func (c *CommandCenter) storeDaily(timestamp time.Time) {
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Daily total - basal: " + fmt.Sprint(c.state.TodayBasalDelivered) + "U, bolus: " + fmt.Sprint(c.state.TodayBolusDelivered) + "U")
+
+	var basal = uint16(math.Round(float64(c.state.TodayBasalDelivered) * 100))
+	var bolus = uint16(math.Round(float64(c.state.TodayBolusDelivered) * 100))
+	c.state.History = append(c.state.History, HistoryItem{
+		Timestamp: timestamp,
+		Code:      HISTORY_DAILY,
+		// Value holds the basal total & Param7/Param8 the bolus total
+		Value:  basal,
+		Param7: byte(bolus >> 8),
+		Param8: byte(bolus),
+	})
+	c.state.TodayBasalDelivered = 0
+	c.state.TodayBolusDelivered = 0
+}
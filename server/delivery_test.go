@@ -0,0 +1,52 @@
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// startOnFixedClock runs the pump on a fixed clock starting at the given time, without a phone connected
+func startOnFixedClock(t *testing.T, state SimulatorState, start time.Time) (*Simulator, *FixedClock) {
+	t.Helper()
+	useTempWorkingDirectory(t)
+
+	var clock = NewFixedClock(start)
+	var simulator = NewSimulatorWithState(state)
+	simulator.SetClock(clock)
+	simulator.Start(NewLoopbackTransport())
+
+	return &simulator, clock
+}
+
+func TestBasalDeliveryHistory(t *testing.T) {
+	var start = time.Date(2026, 3, 14, 0, 0, 0, 0, time.Local)
+	var simulator, clock = startOnFixedClock(t, NewState(), start)
+
+	clock.Advance(24 * time.Hour)
+
+	// 24 hours of 1U/hr, followed by the daily total of 24U basal & no bolus
+	var hours = 0
+	for _, item := range simulator.State.History {
+		switch item.Code {
+		case HISTORY_BASALHOUR:
+			if expected := start.Add(time.Duration(hours) * time.Hour); !item.Timestamp.Equal(expected) || item.Value != 100 {
+				t.Errorf("expected 1U at %v, got %vU at %v", expected, float32(item.Value)/100, item.Timestamp)
+			}
+			hours++
+		case HISTORY_DAILY:
+			if !item.Timestamp.Equal(start) || item.Value != 2400 || item.Param7 != 0 || item.Param8 != 0 {
+				t.Errorf("expected a daily total of 24U basal at %v, got %+v", start, item)
+			}
+		default:
+			t.Errorf("unexpected history item %+v", item)
+		}
+	}
+	if hours != 24 {
+		t.Errorf("expected 24 basal hours, got %d", hours)
+	}
+
+	if math.Abs(float64(simulator.State.ReservoirLevel-(RESERVOIR_CAPACITY-24))) > 0.01 {
+		t.Errorf("expected a reservoir level of %vU, got %vU", RESERVOIR_CAPACITY-24, simulator.State.ReservoirLevel)
+	}
+}
@@ -3,30 +3,27 @@ package server
 import (
 	"encoding/base64"
 	"fmt"
+	"slices"
 	"time"
 )
 
-// Dana-I
-var ble5Keys = []byte{0x36, 0x36, 0x36, 0x38, 0x36, 0x36}
-var ble5RandomKeys = []byte{
-	secondLvlEncryptionLookup[((ble5Keys[0]-0x30)*10)+ble5Keys[1]-0x30],
-	secondLvlEncryptionLookup[((ble5Keys[2]-0x30)*10)+ble5Keys[3]-0x30],
-	secondLvlEncryptionLookup[((ble5Keys[4]-0x30)*10)+ble5Keys[5]-0x30],
-}
-
-// DanaRS-v3
-var pairingKeys = []byte{0x79, 0x6F, 0x49, 0xcf, 0xe1, 0x8b}
-var randomPairingKeys = []byte{0x37, 0x95, 0xd7, 0x8f}
-
-// DanaRS-v1
-var timeSecret = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-var passKeySecret = []byte{0x00, 0x00}
-var passwordSecret = []byte{0x00, 0x00}
-
 type DanaEncryption struct {
 	state *SimulatorState
 
 	randomSyncKey byte
+
+	// DanaRS-v1
+	timeSecret     []byte
+	passwordSecret []byte
+}
+
+func NewDanaEncryption(state *SimulatorState) *DanaEncryption {
+	return &DanaEncryption{
+		state:          state,
+		randomSyncKey:  0,
+		timeSecret:     []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		passwordSecret: []byte{0x00, 0x00},
+	}
 }
 
 type EncryptionParams struct {
@@ -38,7 +35,7 @@ type EncryptionParams struct {
 
 func (e *DanaEncryption) ResetRandomSyncKey() {
 	fmt.Println("Reset random sync key")
-	e.randomSyncKey = initialRandomSyncKey(pairingKeys)
+	e.randomSyncKey = initialRandomSyncKey(e.state.PairingKeys)
 }
 
 func (e DanaEncryption) EncodePumpBusy() []byte {
@@ -59,6 +56,8 @@ func (e *DanaEncryption) Encryption(params EncryptionParams) []byte {
 			return e.encodePumpCheck()
 		case OPCODE_ENCRYPTION__TIME_INFORMATION:
 			return e.encodeTimeInformation()
+		case OPCODE_ENCRYPTION__PASSKEY_RETURN:
+			return e.encodePassKeyReturn()
 		}
 	}
 
@@ -66,6 +65,10 @@ func (e *DanaEncryption) Encryption(params EncryptionParams) []byte {
 }
 
 func (e *DanaEncryption) EncryptionSecondLvl(data []byte) []byte {
+	var pairingKeys = e.state.PairingKeys
+	var randomPairingKeys = e.state.RandomPairingKeys
+	var ble5RandomKeys = getBle5RandomKeys(e.state.Ble5Keys)
+
 	if e.state.PumpType == PUMP_TYPE_DANA_RS_V3 {
 		var updatedRandomSyncKey = e.randomSyncKey
 		if data[0] == 0xa5 && data[1] == 0xa5 {
@@ -139,9 +142,11 @@ func (e *DanaEncryption) EncryptionSecondLvl(data []byte) []byte {
 func (e *DanaEncryption) Decryption(data []byte) []byte {
 	data = encodePacketSerialNumber(&data, e.state.Name)
 
-	var isEncryptionCommand = data[3] == 1
-	if isEncryptionCommand && e.state.PumpType == PUMP_TYPE_DANA_RS_V1 {
-		panic("DanaRSv1 not supported yet (Decryption !isSecure)")
+	var isEncryptionCommand = data[3] == TYPE_ENCRYPTION_REQUEST
+	if !isEncryptionCommand && e.state.PumpType == PUMP_TYPE_DANA_RS_V1 {
+		data = encodePacketTime(&data, e.timeSecret)
+		data = encodePacketPassword(&data, e.passwordSecret)
+		data = encodePacketPassKey(&data, e.passKeySecret())
 	}
 
 	if int(data[2]) != (len(data) - 7) {
@@ -161,7 +166,19 @@ func (e *DanaEncryption) Decryption(data []byte) []byte {
 	return content
 }
 
+// PeekDecryptionSecondLvl decrypts a copy of the data, without moving the random sync key of the DanaRS-v3 on
+func (e *DanaEncryption) PeekDecryptionSecondLvl(data []byte) []byte {
+	var randomSyncKey = e.randomSyncKey
+	defer func() { e.randomSyncKey = randomSyncKey }()
+
+	return e.DecryptionSecondLvl(slices.Clone(data))
+}
+
 func (e *DanaEncryption) DecryptionSecondLvl(data []byte) []byte {
+	var pairingKeys = e.state.PairingKeys
+	var randomPairingKeys = e.state.RandomPairingKeys
+	var ble5RandomKeys = getBle5RandomKeys(e.state.Ble5Keys)
+
 	if e.state.PumpType == PUMP_TYPE_DANA_RS_V3 {
 		for i := 0; i < len(data); i++ {
 			var copyRandomSyncKey = data[i]
@@ -246,12 +263,12 @@ func (e *DanaEncryption) encodePumpCheck() []byte {
 		data[5] = 0x13
 
 		// BLE-5 keys
-		data[6] = ble5Keys[0]
-		data[7] = ble5Keys[1]
-		data[8] = ble5Keys[2]
-		data[9] = ble5Keys[3]
-		data[10] = ble5Keys[4]
-		data[11] = ble5Keys[5]
+		data[6] = e.state.Ble5Keys[0]
+		data[7] = e.state.Ble5Keys[1]
+		data[8] = e.state.Ble5Keys[2]
+		data[9] = e.state.Ble5Keys[3]
+		data[10] = e.state.Ble5Keys[4]
+		data[11] = e.state.Ble5Keys[5]
 	} else if e.state.PumpType == PUMP_TYPE_DANA_RS_V3 {
 		// Hardware model
 		data[3] = 0x05
@@ -261,9 +278,9 @@ func (e *DanaEncryption) encodePumpCheck() []byte {
 		data[5] = 0x11
 
 		// Random sync key
-		e.randomSyncKey = initialRandomSyncKey(pairingKeys)
+		e.randomSyncKey = initialRandomSyncKey(e.state.PairingKeys)
 		fmt.Println("RandomSyncKey: " + fmt.Sprint(e.randomSyncKey))
-		data[6] = encryptionRandomSyncKey(e.randomSyncKey, randomPairingKeys)
+		data[6] = encryptionRandomSyncKey(e.randomSyncKey, e.state.RandomPairingKeys)
 	} else {
 		data[3] = 0x04
 	}
@@ -271,17 +288,62 @@ func (e *DanaEncryption) encodePumpCheck() []byte {
 	return e.encodeMessage(data, OPCODE_ENCRYPTION__PUMP_CHECK, true, false)
 }
 
-func (e DanaEncryption) encodeTimeInformation() []byte {
+func (e *DanaEncryption) encodeTimeInformation() []byte {
 	var length byte = 1
+	if e.state.PumpType == PUMP_TYPE_DANA_RS_V1 {
+		length = 8
+	}
 
 	var data = make([]byte, length)
 	if e.state.PumpType != PUMP_TYPE_DANA_RS_V1 {
 		data[0] = 0x00
+	} else {
+		// The DanaRS-v1 secures all other messages with the current time & the user password
+		var now = time.Now()
+		e.timeSecret = []byte{
+			byte(now.Year() - 2000),
+			byte(now.Month()),
+			byte(now.Day()),
+			byte(now.Hour()),
+			byte(now.Minute()),
+			byte(now.Second()),
+		}
+		e.passwordSecret = []byte{byte(e.state.Password), byte(e.state.Password >> 8)}
+
+		copy(data, e.timeSecret)
+		data[6] = e.passwordSecret[0] ^ 0x87
+		data[7] = e.passwordSecret[1] ^ 0x0d
 	}
 
 	return e.encodeMessage(data, OPCODE_ENCRYPTION__TIME_INFORMATION, true, false)
 }
 
+// DecodePassKey verifies the passkey send by the phone during OPCODE_ENCRYPTION__CHECK_PASSKEY
+func (e *DanaEncryption) DecodePassKey(request []byte) bool {
+	if len(request) < 4 {
+		return false
+	}
+
+	return len(e.state.PassKey) == 2 &&
+		encodePacketPassKeySerialNumber(request[2], e.state.Name) == e.state.PassKey[0] &&
+		encodePacketPassKeySerialNumber(request[3], e.state.Name) == e.state.PassKey[1]
+}
+
+// GeneratePassKey creates the new passkey, which is shown on the pump screen during pairing
+func (e *DanaEncryption) GeneratePassKey() []byte {
+	e.state.PassKey = randomBytes(2)
+	return e.state.PassKey
+}
+
+func (e *DanaEncryption) encodePassKeyReturn() []byte {
+	var data = []byte{
+		encodePacketPassKeySerialNumber(e.state.PassKey[0], e.state.Name),
+		encodePacketPassKeySerialNumber(e.state.PassKey[1], e.state.Name),
+	}
+
+	return e.encodeMessage(data, OPCODE_ENCRYPTION__PASSKEY_RETURN, true, false)
+}
+
 func (e DanaEncryption) encodeMessage(data []byte, opCode byte, isEncryptionCommand bool, isNotifyCommand bool) []byte {
 	var length = len(data)
 	var buffer = make([]byte, 9+len(data))
@@ -311,15 +373,24 @@ func (e DanaEncryption) encodeMessage(data []byte, opCode byte, isEncryptionComm
 	buffer[8+length] = 0x5a // footer 2
 
 	var encodedBuffer = encodePacketSerialNumber(&buffer, e.state.Name)
-	if e.state.PumpType == PUMP_TYPE_DANA_RS_V1 && isEncryptionCommand {
-		encodedBuffer = encodePacketTime(&encodedBuffer, timeSecret)
-		encodedBuffer = encodePacketPassword(&encodedBuffer, passwordSecret)
-		encodedBuffer = encodePacketPassKey(&encodedBuffer, passKeySecret)
+	if e.state.PumpType == PUMP_TYPE_DANA_RS_V1 && !isEncryptionCommand {
+		encodedBuffer = encodePacketTime(&encodedBuffer, e.timeSecret)
+		encodedBuffer = encodePacketPassword(&encodedBuffer, e.passwordSecret)
+		encodedBuffer = encodePacketPassKey(&encodedBuffer, e.passKeySecret())
 	}
 
 	return encodedBuffer
 }
 
+// passKeySecret returns the paired passkey of the DanaRS-v1, or an empty secret when not paired yet
+func (e DanaEncryption) passKeySecret() []byte {
+	if len(e.state.PassKey) != 2 {
+		return []byte{0x00, 0x00}
+	}
+
+	return e.state.PassKey
+}
+
 func generateCrc(buffer []byte, pumpType int, isEncryptionCommand bool) uint16 {
 	var crc uint16 = 0
 
@@ -461,6 +532,18 @@ func getDescPairingKey(buffer *[]byte, pairingKey []byte, globalRandomSyncKey ui
 	return newRandomSyncKey, *buffer
 }
 
+func getBle5RandomKeys(ble5Keys []byte) []byte {
+	if len(ble5Keys) != 6 {
+		return []byte{0x00, 0x00, 0x00}
+	}
+
+	return []byte{
+		secondLvlEncryptionLookup[((ble5Keys[0]-0x30)*10)+ble5Keys[1]-0x30],
+		secondLvlEncryptionLookup[((ble5Keys[2]-0x30)*10)+ble5Keys[3]-0x30],
+		secondLvlEncryptionLookup[((ble5Keys[4]-0x30)*10)+ble5Keys[5]-0x30],
+	}
+}
+
 func encryptionRandomSyncKey(randomSyncKey uint8, randomPairingKey []byte) uint8 {
 	var tmp uint8 = 0
 
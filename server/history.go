@@ -0,0 +1,380 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// History codes of the records, as requested by the review opcodes
+var HistoryReviewCodes = map[byte]byte{
+	OPCODE_REVIEW__BOLUS:         HISTORYBOLUS,
+	OPCODE_REVIEW__DAILY:         HISTORY_DAILY,
+	OPCODE_REVIEW__PRIME:         HISTORY_PRIME,
+	OPCODE_REVIEW__REFILL:        HISTORY_REFILL,
+	OPCODE_REVIEW__BLOOD_GLUCOSE: HISTORY_GLUCOSE,
+	OPCODE_REVIEW__CARBOHYDRATE:  HISTORY_CARBO,
+	OPCODE_REVIEW__TEMPORARY:     HISTORY_TEMP_BASAL,
+	OPCODE_REVIEW__SUSPEND:       HISTORY_SUSPEND,
+	OPCODE_REVIEW__ALARM:         HISTORY_ALARM,
+	OPCODE_REVIEW__BASAL:         HISTORY_BASALHOUR,
+}
+
+// Event types of the APS history, as written with OPCODE__APS_SET_EVENT_HISTORY
+const (
+	APS_EVENT_TEMP_START          byte = 0x01
+	APS_EVENT_TEMP_STOP           byte = 0x02
+	APS_EVENT_EXTENDED_START      byte = 0x03
+	APS_EVENT_EXTENDED_STOP       byte = 0x04
+	APS_EVENT_BOLUS               byte = 0x05
+	APS_EVENT_DUAL_BOLUS          byte = 0x06
+	APS_EVENT_DUAL_EXTENDED_START byte = 0x07
+	APS_EVENT_DUAL_EXTENDED_STOP  byte = 0x08
+	APS_EVENT_SUSPEND_ON          byte = 0x09
+	APS_EVENT_SUSPEND_OFF         byte = 0x0a
+	APS_EVENT_REFILL              byte = 0x0b
+	APS_EVENT_PRIME               byte = 0x0c
+	APS_EVENT_PROFILE_CHANGE      byte = 0x0d
+	APS_EVENT_CARBS               byte = 0x0e
+	APS_EVENT_PRIME_CANNULA       byte = 0x0f
+	APS_EVENT_TIME_CHANGE         byte = 0x10
+
+	// Marks the end of the APS history events
+	APS_EVENT_DONE byte = 0xff
+)
+
+type ApsHistoryEvent struct {
+	Timestamp time.Time
+	Code      byte
+	Param1    uint16
+	Param2    uint16
+}
+
+// Days over which the bolus average is reported
+var bolusAverageDays = []int{3, 7, 14, 21, 28}
+
+func (c *CommandCenter) respondToHistoryRequest(code byte, from time.Time) {
+	var filterOnDate = func(h HistoryItem) bool { return !h.Timestamp.Before(from) }
+	var filterOnCode = func(h HistoryItem) bool { return h.Code == HistoryReviewCodes[code] }
+	if code == OPCODE_REVIEW__ALL_HISTORY {
+		filterOnCode = func(h HistoryItem) bool {
+			for _, historyCode := range HistoryReviewCodes {
+				if h.Code == historyCode {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	var items = filter(filter(c.state.History, filterOnDate), filterOnCode)
+	// Extended boluses are stored once they are done, but belong at the time they started
+	slices.SortStableFunc(items, func(a, b HistoryItem) int { return a.Timestamp.Compare(b.Timestamp) })
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Uploading history items. Count: " + fmt.Sprint(len(items)))
+
+	for _, item := range items {
+		var message = encodeHistoryItem(item)
+
+		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending history item - Data: " + base64.StdEncoding.EncodeToString(message))
+		c.encodeAndWrite(code, message)
+	}
+
+	// Send upload done message, with the amount of records send
+	var message = []byte{0x00, byte(len(items)), byte(len(items) >> 8)}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Done uploading history - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(code, message)
+}
+
+// encodeHistoryItem encodes a record of the history upload. Values are send big-endian, unlike the rest of the protocol
+func encodeHistoryItem(item HistoryItem) []byte {
+	var message = make([]byte, 11)
+	message[0] = item.Code
+	message[1] = byte(item.Timestamp.Year() - 2000)
+	message[2] = byte(item.Timestamp.Month())
+	message[3] = byte(item.Timestamp.Day())
+
+	if item.Code == HISTORY_DAILY {
+		// A daily record only has a date, followed by the basal & bolus total
+		message[4] = byte(item.Value >> 8)
+		message[5] = byte(item.Value)
+		message[6] = item.Param7
+		message[7] = item.Param8
+		return message
+	}
+
+	message[4] = byte(item.Timestamp.Hour())
+	message[5] = byte(item.Timestamp.Minute())
+	message[6] = byte(item.Timestamp.Second())
+	message[7] = item.Param7
+	message[8] = item.Param8
+	message[9] = byte(item.Value >> 8)
+	message[10] = byte(item.Value)
+
+	return message
+}
+
+// respondToBolusAverage sends the average daily bolus total over the last 3, 7, 14, 21 & 28 days
+func (c *CommandCenter) respondToBolusAverage() {
+	var now = c.clock.Now()
+	var today = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	var message = make([]byte, 0, len(bolusAverageDays)*2)
+	for _, days := range bolusAverageDays {
+		var from = today.AddDate(0, 0, -days)
+
+		var total = 0
+		for _, item := range c.state.History {
+			if item.Code == HISTORY_DAILY && !item.Timestamp.Before(from) && item.Timestamp.Before(today) {
+				total += int(item.Param7)<<8 | int(item.Param8)
+			}
+		}
+
+		var average = total / days
+		message = append(message, byte(average), byte(average>>8))
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_REVIEW__BOLUS_AVG - Data: " + base64.StdEncoding.EncodeToString(message))
+	c.encodeAndWrite(OPCODE_REVIEW__BOLUS_AVG, message)
+}
+
+// respondToSetEventHistory stores an event of the APS app in the history. The request holds the event type, the
+// date (in UTC for the Dana-I) & 2 big-endian parameters
+func (c *CommandCenter) respondToSetEventHistory(request []byte) {
+	if len(request) < 13 {
+		c.rejectHistory(OPCODE__APS_SET_EVENT_HISTORY, "request too short")
+		return
+	}
+
+	var eventType = request[2]
+	var timestamp = getDate(request, 1, c.historyLocation()).In(time.Local)
+	var param1 = uint16(request[9])<<8 | uint16(request[10])
+	var param2 = uint16(request[11])<<8 | uint16(request[12])
+
+	switch eventType {
+	case APS_EVENT_CARBS:
+		c.state.History = append(c.state.History, HistoryItem{
+			Timestamp: timestamp,
+			Code:      HISTORY_CARBO,
+			Value:     param1,
+		})
+	case APS_EVENT_TEMP_START:
+		// Param1 holds the percentage & param2 the duration in minutes
+		c.state.History = append(c.state.History, HistoryItem{
+			Timestamp: timestamp,
+			Code:      HISTORY_TEMP_BASAL,
+			Value:     param1,
+			Param7:    byte(param2 % 60),
+			Param8:    byte(param2 / 60),
+		})
+	case APS_EVENT_TEMP_STOP:
+		c.stopTempBasalHistory(timestamp)
+	case APS_EVENT_SUSPEND_ON, APS_EVENT_SUSPEND_OFF:
+		var param8 byte = 'F'
+		if eventType == APS_EVENT_SUSPEND_ON {
+			param8 = 'O'
+		}
+		c.state.History = append(c.state.History, HistoryItem{
+			Timestamp: timestamp,
+			Code:      HISTORY_SUSPEND,
+			Param8:    param8,
+		})
+	default:
+		c.rejectHistory(OPCODE__APS_SET_EVENT_HISTORY, "unsupported event type "+fmt.Sprint(eventType))
+		return
+	}
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE__APS_SET_EVENT_HISTORY - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE__APS_SET_EVENT_HISTORY, []byte{0x00})
+}
+
+// stopTempBasalHistory shortens the temp basal in the history which was running at the given time
+func (c *CommandCenter) stopTempBasalHistory(endedAt time.Time) {
+	for i := len(c.state.History) - 1; i >= 0; i-- {
+		var item = &c.state.History[i]
+		if item.Code != HISTORY_TEMP_BASAL || item.Timestamp.After(endedAt) {
+			continue
+		}
+
+		var minutes = int(endedAt.Sub(item.Timestamp).Minutes())
+		if minutes < int(item.Param8)*60+int(item.Param7) {
+			item.Param7 = byte(minutes % 60)
+			item.Param8 = byte(minutes / 60)
+		}
+		return
+	}
+}
+
+// respondToSetHistorySave stores a record in the history, like a blood glucose measurement. The request holds the
+// history code, the date, the code of the record (Param8) & a little-endian value
+func (c *CommandCenter) respondToSetHistorySave(request []byte) {
+	if len(request) < 12 {
+		c.rejectHistory(OPCODE_ETC__SET_HISTORY_SAVE, "request too short")
+		return
+	}
+
+	var code = request[2]
+	var reviewed = false
+	for _, historyCode := range HistoryReviewCodes {
+		reviewed = reviewed || historyCode == code
+	}
+	if !reviewed {
+		c.rejectHistory(OPCODE_ETC__SET_HISTORY_SAVE, "unknown history code "+fmt.Sprint(code))
+		return
+	}
+
+	c.state.History = append(c.state.History, HistoryItem{
+		Timestamp: getDate(request, 1, c.historyLocation()).In(time.Local),
+		Code:      code,
+		Param8:    request[9],
+		Value:     uint16(request[10]) | uint16(request[11])<<8,
+	})
+	c.state.Save()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending OPCODE_ETC__SET_HISTORY_SAVE - Data: " + base64.StdEncoding.EncodeToString([]byte{0x00}))
+	c.encodeAndWrite(OPCODE_ETC__SET_HISTORY_SAVE, []byte{0x00})
+}
+
+func (c *CommandCenter) rejectHistory(code byte, reason string) {
+	fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: Rejecting history, " + reason + " - Data: " + base64.StdEncoding.EncodeToString([]byte{ERROR_CODE_COMMAND}))
+	c.encodeAndWrite(code, []byte{ERROR_CODE_COMMAND})
+}
+
+// historyLocation returns the time zone of the dates the phone writes into the history. The Dana-I works in UTC
+func (c *CommandCenter) historyLocation() *time.Location {
+	if c.state.PumpType == PUMP_TYPE_DANA_I {
+		return time.UTC
+	}
+
+	return time.Local
+}
+
+// respondToApsHistoryEvents notifies every APS event since the requested time, one notification per event, followed by
+// APS_EVENT_DONE
+func (c *CommandCenter) respondToApsHistoryEvents(request []byte) {
+	var from = time.Time{}
+	if len(request) >= 8 {
+		from = getDate(request, 0, c.historyLocation())
+	}
+
+	var events = filter(c.apsHistoryEvents(), func(e ApsHistoryEvent) bool { return !e.Timestamp.Before(from) })
+	slices.SortStableFunc(events, func(a, b ApsHistoryEvent) int { return a.Timestamp.Compare(b.Timestamp) })
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Sending APS history events. Count: " + fmt.Sprint(len(events)))
+	for _, event := range events {
+		c.encodeAndNotify(OPCODE__APS_HISTORY_EVENTS, c.encodeApsHistoryEvent(event))
+	}
+
+	var message = make([]byte, 11)
+	message[0] = APS_EVENT_DONE
+	c.encodeAndNotify(OPCODE__APS_HISTORY_EVENTS, message)
+}
+
+// apsHistoryEvents converts the history into APS events. Deliveries with a duration turn into a start & stop event,
+// the running temp basal & extended bolus only have their start event. Alarms have no APS event, the phone reads them
+// with OPCODE_REVIEW__ALARM
+func (c *CommandCenter) apsHistoryEvents() []ApsHistoryEvent {
+	var events = []ApsHistoryEvent{}
+	var addDelivery = func(startCode byte, startedAt time.Time, param1 uint16, minutes int) {
+		events = append(events,
+			ApsHistoryEvent{Timestamp: startedAt, Code: startCode, Param1: param1, Param2: uint16(minutes)},
+			// The stop code always directly follows the start code
+			ApsHistoryEvent{Timestamp: startedAt.Add(time.Duration(minutes) * time.Minute), Code: startCode + 1, Param1: param1, Param2: uint16(minutes)},
+		)
+	}
+
+	for _, item := range c.state.History {
+		switch item.Code {
+		case HISTORYBOLUS:
+			var minutes = int(item.Param8&0x0f)*60 + int(item.Param7)
+			switch item.Param8 & 0xf0 {
+			case BOLUS_TYPE_EXTENDED:
+				addDelivery(APS_EVENT_EXTENDED_START, item.Timestamp, item.Value, minutes)
+			case BOLUS_TYPE_DUAL_EXTENDED:
+				addDelivery(APS_EVENT_DUAL_EXTENDED_START, item.Timestamp, item.Value, minutes)
+			case BOLUS_TYPE_DUAL_STEP:
+				events = append(events, ApsHistoryEvent{Timestamp: item.Timestamp, Code: APS_EVENT_DUAL_BOLUS, Param1: item.Value})
+			default:
+				events = append(events, ApsHistoryEvent{Timestamp: item.Timestamp, Code: APS_EVENT_BOLUS, Param1: item.Value})
+			}
+		case HISTORY_TEMP_BASAL:
+			addDelivery(APS_EVENT_TEMP_START, item.Timestamp, item.Value, int(item.Param8)*60+int(item.Param7))
+		case HISTORY_SUSPEND:
+			var code = APS_EVENT_SUSPEND_OFF
+			if item.Param8 == 'O' {
+				code = APS_EVENT_SUSPEND_ON
+			}
+			events = append(events, ApsHistoryEvent{Timestamp: item.Timestamp, Code: code})
+		case HISTORY_PRIME:
+			var code = APS_EVENT_PRIME
+			if item.Param8 == PRIME_TYPE_CANNULA {
+				code = APS_EVENT_PRIME_CANNULA
+			}
+			events = append(events, ApsHistoryEvent{Timestamp: item.Timestamp, Code: code, Param1: item.Value})
+		case HISTORY_REFILL:
+			events = append(events, ApsHistoryEvent{Timestamp: item.Timestamp, Code: APS_EVENT_REFILL, Param1: item.Value})
+		case HISTORY_CARBO:
+			events = append(events, ApsHistoryEvent{Timestamp: item.Timestamp, Code: APS_EVENT_CARBS, Param1: item.Value})
+		case HISTORY_PROFILE_CHANGE:
+			// The high byte of param1 holds the profile number
+			events = append(events, ApsHistoryEvent{Timestamp: item.Timestamp, Code: APS_EVENT_PROFILE_CHANGE, Param1: item.Value << 8})
+		}
+	}
+
+	if c.state.TempBasalActiveTill != nil {
+		var startedAt = c.tempBasalStartedAt()
+		events = append(events, ApsHistoryEvent{
+			Timestamp: startedAt,
+			Code:      APS_EVENT_TEMP_START,
+			Param1:    uint16(c.state.TempBasalPercentage),
+			Param2:    uint16(c.state.TempBasalActiveTill.Sub(startedAt).Minutes()),
+		})
+	}
+
+	if c.state.ExtendedBolusStartedAt != nil && c.state.ExtendedBolusActiveTill != nil {
+		var code = APS_EVENT_EXTENDED_START
+		if c.state.IsDualBolus {
+			code = APS_EVENT_DUAL_EXTENDED_START
+		}
+		events = append(events, ApsHistoryEvent{
+			Timestamp: *c.state.ExtendedBolusStartedAt,
+			Code:      code,
+			Param1:    uint16(c.state.ExtendedBolusAmount * 100),
+			Param2:    uint16(c.state.ExtendedBolusActiveTill.Sub(*c.state.ExtendedBolusStartedAt).Minutes()),
+		})
+	}
+
+	return events
+}
+
+// encodeApsHistoryEvent encodes an APS event, with big-endian parameters. The Dana-I sends the time as big-endian
+// UTC epoch seconds instead of a date
+func (c *CommandCenter) encodeApsHistoryEvent(event ApsHistoryEvent) []byte {
+	var message = make([]byte, 11)
+	message[0] = event.Code
+
+	if c.state.PumpType == PUMP_TYPE_DANA_I {
+		var epoch = uint32(event.Timestamp.Unix())
+		message[3] = byte(epoch >> 24)
+		message[4] = byte(epoch >> 16)
+		message[5] = byte(epoch >> 8)
+		message[6] = byte(epoch)
+	} else {
+		message[1] = byte(event.Timestamp.Year() - 2000)
+		message[2] = byte(event.Timestamp.Month())
+		message[3] = byte(event.Timestamp.Day())
+		message[4] = byte(event.Timestamp.Hour())
+		message[5] = byte(event.Timestamp.Minute())
+		message[6] = byte(event.Timestamp.Second())
+	}
+
+	message[7] = byte(event.Param1 >> 8)
+	message[8] = byte(event.Param1)
+	message[9] = byte(event.Param2 >> 8)
+	message[10] = byte(event.Param2)
+
+	return message
+}
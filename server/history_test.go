@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestApsHistoryEvents(t *testing.T) {
+	var tests = []struct {
+		name     string
+		pumpType int
+		location *time.Location
+		expected [][]byte
+	}{
+		{
+			name:     "DanaRS-v3",
+			pumpType: PUMP_TYPE_DANA_RS_V3,
+			location: time.Local,
+			expected: [][]byte{
+				{APS_EVENT_BOLUS, 26, 3, 14, 11, 0, 0, 0x00, 0x64, 0x00, 0x00},
+				{APS_EVENT_CARBS, 26, 3, 14, 11, 10, 0, 0x00, 0x14, 0x00, 0x00},
+				{APS_EVENT_DONE, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			},
+		},
+		{
+			// The Dana-I sends the UTC epoch instead of the date
+			name:     "Dana-I",
+			pumpType: PUMP_TYPE_DANA_I,
+			location: time.UTC,
+			expected: [][]byte{
+				{APS_EVENT_BOLUS, 0, 0, 0x69, 0xb5, 0x3f, 0xb0, 0x00, 0x64, 0x00, 0x00},
+				{APS_EVENT_CARBS, 0, 0, 0x69, 0xb5, 0x42, 0x08, 0x00, 0x14, 0x00, 0x00},
+				{APS_EVENT_DONE, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state = NewState()
+			state.PumpType = test.pumpType
+			state.History = []HistoryItem{
+				{Timestamp: time.Date(2026, 3, 14, 11, 0, 0, 0, test.location), Code: HISTORYBOLUS, Value: 100},
+				// Alarms are not part of the APS events
+				{Timestamp: time.Date(2026, 3, 14, 11, 5, 0, 0, test.location), Code: HISTORY_ALARM, Param8: 'O'},
+				{Timestamp: time.Date(2026, 3, 14, 11, 10, 0, 0, test.location), Code: HISTORY_CARBO, Value: 20},
+			}
+
+			var _, client, _ = startLoopbackWithState(t, state)
+			if err := client.send(TYPE_COMMAND, OPCODE__APS_HISTORY_EVENTS, []byte{26, 3, 14, 0, 0, 0}); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, expected := range test.expected {
+				var data, err = client.WaitForNotification(OPCODE__APS_HISTORY_EVENTS)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, expected) {
+					t.Errorf("event %d: expected %v, got %v", i, expected, data)
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryReview(t *testing.T) {
+	var at = func(day int, hour int, minute int, second int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, second, 0, time.Local)
+	}
+
+	var state = NewState()
+	state.History = []HistoryItem{
+		// Before the requested date
+		{Timestamp: at(12, 9, 0, 0), Code: HISTORYBOLUS, Value: 200},
+		{Timestamp: at(13, 0, 0, 0), Code: HISTORY_DAILY, Value: 2400, Param7: 0x01, Param8: 0xf4},
+		// An extended bolus of 1.5U over 1h30m
+		{Timestamp: at(14, 10, 20, 30), Code: HISTORYBOLUS, Value: 150, Param7: 30, Param8: 0x80 | 1},
+		{Timestamp: at(14, 11, 5, 0), Code: HISTORY_ALARM, Param8: 'O'},
+	}
+
+	var tests = []struct {
+		name     string
+		code     byte
+		expected [][]byte
+	}{
+		// Code, date & time, param 7 & 8 and the value big-endian, as DanaRSPacketHistory parses them
+		{"bolus", OPCODE_REVIEW__BOLUS, [][]byte{
+			{HISTORYBOLUS, 26, 3, 14, 10, 20, 30, 0x1e, 0x81, 0x00, 0x96},
+			{0x00, 0x01, 0x00},
+		}},
+		// A daily record has the basal & bolus total (24U & 5U) right after the date
+		{"daily", OPCODE_REVIEW__DAILY, [][]byte{
+			{HISTORY_DAILY, 26, 3, 13, 0x09, 0x60, 0x01, 0xf4, 0x00, 0x00, 0x00},
+			{0x00, 0x01, 0x00},
+		}},
+		{"alarm", OPCODE_REVIEW__ALARM, [][]byte{
+			{HISTORY_ALARM, 26, 3, 14, 11, 5, 0, 0x00, 'O', 0x00, 0x00},
+			{0x00, 0x01, 0x00},
+		}},
+		{"nothing", OPCODE_REVIEW__PRIME, [][]byte{
+			{0x00, 0x00, 0x00},
+		}},
+		{"all", OPCODE_REVIEW__ALL_HISTORY, [][]byte{
+			{HISTORY_DAILY, 26, 3, 13, 0x09, 0x60, 0x01, 0xf4, 0x00, 0x00, 0x00},
+			{HISTORYBOLUS, 26, 3, 14, 10, 20, 30, 0x1e, 0x81, 0x00, 0x96},
+			{HISTORY_ALARM, 26, 3, 14, 11, 5, 0, 0x00, 'O', 0x00, 0x00},
+			{0x00, 0x03, 0x00},
+		}},
+	}
+
+	var _, client, _ = startLoopbackWithState(t, state)
+	if err := client.SetHistoryUploadMode(true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := client.send(TYPE_COMMAND, test.code, []byte{26, 3, 13, 0, 0, 0}); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, expected := range test.expected {
+				var packet, ok = client.responses.pop(client.Timeout)
+				if !ok {
+					t.Fatalf("record %d: timeout", i)
+				}
+				if !bytes.Equal(packet[2:], expected) {
+					t.Errorf("record %d: expected %v, got %v", i, expected, packet[2:])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+// Peak activity of rapid-acting insulin, used by the exponential insulin curve
+const INSULIN_PEAK = 75 * time.Minute
+
+// insulinOnBoard calculates the bolus insulin which is still active, based on the bolus history & the running
+// extended bolus. Like the real pump, the basal is left out
+func (c *CommandCenter) insulinOnBoard() float32 {
+	var now = c.clock.Now()
+	var insulinDuration = time.Duration(c.state.InsulinDurationInHours * float32(time.Hour))
+
+	var insulinOnBoard float32 = 0
+	for _, item := range c.state.History {
+		if item.Code != HISTORYBOLUS {
+			continue
+		}
+
+		// Param7 holds the minutes of the duration & the lower nibble of Param8 the hours
+		var duration = time.Duration(item.Param7)*time.Minute + time.Duration(item.Param8&0x0f)*time.Hour
+		if now.Sub(item.Timestamp) >= duration+insulinDuration {
+			continue
+		}
+
+		insulinOnBoard += spreadInsulinOnBoard(float32(item.Value)/100, item.Timestamp, duration, now, insulinDuration)
+	}
+
+	if c.state.ExtendedBolusStartedAt != nil {
+		var startedAt = *c.state.ExtendedBolusStartedAt
+		insulinOnBoard += spreadInsulinOnBoard(c.state.ExtendedBolusDelivered, startedAt, now.Sub(startedAt), now, insulinDuration)
+	}
+
+	return insulinOnBoard
+}
+
+// spreadInsulinOnBoard calculates the insulin on board of an amount which has been delivered evenly over the duration,
+// like an extended bolus. The delivery is split into parts of 5 minutes
+func spreadInsulinOnBoard(amount float32, startedAt time.Time, duration time.Duration, now time.Time, insulinDuration time.Duration) float32 {
+	if duration <= 0 {
+		return amount * insulinOnBoardFraction(now.Sub(startedAt), insulinDuration)
+	}
+
+	var parts = int(math.Ceil(float64(duration) / float64(5*time.Minute)))
+	var partDuration = duration / time.Duration(parts)
+
+	var insulinOnBoard float32 = 0
+	for i := 0; i < parts; i++ {
+		var deliveredAt = startedAt.Add(partDuration*time.Duration(i) + partDuration/2)
+		insulinOnBoard += amount / float32(parts) * insulinOnBoardFraction(now.Sub(deliveredAt), insulinDuration)
+	}
+
+	return insulinOnBoard
+}
+
+// insulinOnBoardFraction returns the fraction of a bolus which is still active after the elapsed time, following the
+// exponential insulin curve (as used by oref & Loop)
+func insulinOnBoardFraction(elapsed time.Duration, insulinDuration time.Duration) float32 {
+	if elapsed <= 0 {
+		return 1
+	}
+	if elapsed >= insulinDuration {
+		return 0
+	}
+
+	var t = elapsed.Minutes()
+	var td = insulinDuration.Minutes()
+	// The peak has to be before the half of the insulin duration, else the curve doesnt exist
+	var tp = min(INSULIN_PEAK.Minutes(), td/2-1)
+
+	var tau = tp * (1 - tp/td) / (1 - 2*tp/td)
+	var a = 2 * tau / td
+	var s = 1 / (1 - a + (1+a)*math.Exp(-td/tau))
+
+	return float32(1 - s*(1-a)*((t*t/(tau*td*(1-a))-t/tau-1)*math.Exp(-t/tau)+1))
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestInsulinOnBoardFraction(t *testing.T) {
+	var tests = []struct {
+		elapsed         time.Duration
+		insulinDuration time.Duration
+		expected        float32
+	}{
+		{-time.Minute, 5 * time.Hour, 1},
+		{0, 5 * time.Hour, 1},
+		{30 * time.Minute, 5 * time.Hour, 0.9250},
+		{time.Hour, 5 * time.Hour, 0.7640},
+		{INSULIN_PEAK, 5 * time.Hour, 0.6726},
+		{2 * time.Hour, 5 * time.Hour, 0.4106},
+		{3 * time.Hour, 5 * time.Hour, 0.1588},
+		{4 * time.Hour, 5 * time.Hour, 0.0329},
+		{5 * time.Hour, 5 * time.Hour, 0},
+		{time.Hour, 3 * time.Hour, 0.6878},
+		// The peak moves before the half of a short insulin duration
+		{time.Hour, 2 * time.Hour, 0.4937},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.elapsed, " of ", test.insulinDuration), func(t *testing.T) {
+			var fraction = insulinOnBoardFraction(test.elapsed, test.insulinDuration)
+			if math.Abs(float64(fraction-test.expected)) > 0.0001 {
+				t.Errorf("expected %v, got %v", test.expected, fraction)
+			}
+		})
+	}
+}
+
+func TestInsulinOnBoardAndDailyTotals(t *testing.T) {
+	var tests = []struct {
+		insulinDuration float32
+		// The insulin on board in 0.01U of the 1U bolus an hour ago
+		expected byte
+	}{
+		{5, 0x4c},
+		{3, 0x44},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.insulinDuration, "h"), func(t *testing.T) {
+			var state = NewState()
+			state.InsulinDurationInHours = test.insulinDuration
+
+			var _, client, clock = startLoopbackWithState(t, state)
+
+			if err := client.Bolus(1, 0); err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(time.Hour)
+
+			runCommandTests(t, client, []commandTest{
+				// Total, basal & bolus: 1U/hr of basal & the 1U bolus
+				{"today delivery total", OPCODE_REVIEW__GET_TODAY_DELIVERY_TOTAL, []byte{}, []byte{0xc8, 0x00, 0x64, 0x00, 0x64, 0x00}},
+				// Daily total 2U, max daily total 250U, reservoir 298U, basal 1U/hr, no temp basal, battery 100% & the
+				// insulin on board at bytes 13-14
+				{"initial screen", OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, []byte{}, []byte{0x00, 0xc8, 0x00, 0xa8, 0x61, 0x68, 0x74, 0x64, 0x00, 0x64, 0x64, 0x00, 0x00, test.expected, 0x00, 0x00}},
+			})
+		})
+	}
+}
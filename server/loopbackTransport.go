@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"slices"
+)
+
+// LoopbackTransport connects the simulator to an in-process phone (like the Client) without any radio.
+// Frames are delivered synchronously, which makes it suitable for go tests
+type LoopbackTransport struct {
+	onReceive func(data []byte)
+	onWrite   func(data []byte)
+}
+
+func NewLoopbackTransport() *LoopbackTransport {
+	return &LoopbackTransport{}
+}
+
+func (t *LoopbackTransport) Start(name string, onReceive func(data []byte)) error {
+	t.onReceive = onReceive
+	return nil
+}
+
+// Write delivers a frame from the simulator to the phone
+func (t *LoopbackTransport) Write(data []byte) error {
+	if t.onWrite == nil {
+		return errors.New("no phone connected to the loopback")
+	}
+
+	t.onWrite(slices.Clone(data))
+	return nil
+}
+
+// Connect registers the phone side of the loopback
+func (t *LoopbackTransport) Connect(onWrite func(data []byte)) {
+	t.onWrite = onWrite
+}
+
+// Send delivers a frame from the phone to the simulator
+func (t *LoopbackTransport) Send(data []byte) error {
+	if t.onReceive == nil {
+		return errors.New("simulator has not been started on the loopback")
+	}
+
+	t.onReceive(slices.Clone(data))
+	return nil
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+var testStartTime = time.Date(2026, 3, 14, 12, 0, 0, 0, time.Local)
+
+// startLoopback runs a fresh pump on a fixed clock & connects a client to it
+func startLoopback(t *testing.T, pumpType int) (*Simulator, *Client, *FixedClock) {
+	t.Helper()
+
+	var state = NewState()
+	state.PumpType = pumpType
+
+	return startLoopbackWithState(t, state)
+}
+
+// startLoopbackWithState runs the pump on a fixed clock & connects a client to it
+func startLoopbackWithState(t *testing.T, state SimulatorState) (*Simulator, *Client, *FixedClock) {
+	t.Helper()
+	useTempWorkingDirectory(t)
+
+	var clock = NewFixedClock(testStartTime)
+	var simulator = NewSimulatorWithState(state)
+	simulator.SetClock(clock)
+
+	var transport = NewLoopbackTransport()
+	simulator.Start(transport)
+
+	var client = NewClient(transport, simulator.State.Name, state.PumpType)
+	client.Timeout = time.Second
+	if state.PumpType == PUMP_TYPE_DANA_RS_V3 {
+		client.PairingKeys = simulator.State.PairingKeys
+		client.RandomPairingKeys = simulator.State.RandomPairingKeys
+	}
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	return &simulator, client, clock
+}
+
+func TestHandshake(t *testing.T) {
+	var pumpTypes = map[string]int{
+		"Dana-I":    PUMP_TYPE_DANA_I,
+		"DanaRS-v3": PUMP_TYPE_DANA_RS_V3,
+		"DanaRS-v1": PUMP_TYPE_DANA_RS_V1,
+	}
+
+	for name, pumpType := range pumpTypes {
+		t.Run(name, func(t *testing.T) {
+			var simulator, client, _ = startLoopback(t, pumpType)
+
+			// A second lvl encrypted command only succeeds when both sides agree on the keys
+			var information, err = client.InitialScreenInformation()
+			if err != nil {
+				t.Fatalf("failed to read the initial screen: %v", err)
+			}
+
+			if information.ReservoirLevel != float32(simulator.State.ReservoirLevel) {
+				t.Errorf("expected a reservoir level of %vU, got %vU", simulator.State.ReservoirLevel, information.ReservoirLevel)
+			}
+		})
+	}
+}
+
+func TestEncryptedStartByte(t *testing.T) {
+	// With these keys the Dana-I encrypts the start of every message into the plain start byte
+	var state = NewState()
+	state.Ble5Keys = []byte("052227")
+
+	var _, client, _ = startLoopbackWithState(t, state)
+	for i := 0; i < 3; i++ {
+		if _, err := client.InitialScreenInformation(); err != nil {
+			t.Fatalf("command %d: %v", i, err)
+		}
+	}
+}
+
+func TestBolusHistory(t *testing.T) {
+	var _, client, clock = startLoopback(t, PUMP_TYPE_DANA_I)
+
+	if err := client.Bolus(1, 0); err != nil {
+		t.Fatalf("failed to start the bolus: %v", err)
+	}
+
+	// 12 seconds per unit
+	clock.Advance(12 * time.Second)
+
+	data, err := client.WaitForNotification(OPCODE_NOTIFY__DELIVERY_COMPLETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered := readUint16(data, 0); delivered != 100 {
+		t.Errorf("expected 1U to be delivered, got %vU", float32(delivered)/100)
+	}
+
+	if err := client.SetHistoryUploadMode(true); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := client.History(OPCODE_REVIEW__BOLUS, testStartTime.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("failed to read the bolus history: %v", err)
+	}
+
+	if len(items) != 1 {
+		t.Fatalf("expected 1 bolus in the history, got %d", len(items))
+	}
+	if items[0].Value != 100 {
+		t.Errorf("expected a bolus of 1U, got %vU", float32(items[0].Value)/100)
+	}
+	if !items[0].Timestamp.Equal(testStartTime) {
+		t.Errorf("expected the bolus to be stamped at %v, got %v", testStartTime, items[0].Timestamp)
+	}
+}
+
+func TestApsTempBasal(t *testing.T) {
+	var _, client, clock = startLoopback(t, PUMP_TYPE_DANA_I)
+
+	if err := client.SetApsTempBasal(150, 15*time.Minute); err != nil {
+		t.Fatalf("failed to start the temp basal: %v", err)
+	}
+
+	tempBasal, err := client.TempBasalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tempBasal.IsInProgress || !tempBasal.IsApsTempBasal || tempBasal.Percentage != 150 || tempBasal.Duration != 15*time.Minute {
+		t.Fatalf("expected an APS temp basal of 150%% for 15m, got %+v", tempBasal)
+	}
+
+	clock.Advance(16 * time.Minute)
+
+	tempBasal, err = client.TempBasalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tempBasal.IsInProgress {
+		t.Fatalf("expected the temp basal to have expired, got %+v", tempBasal)
+	}
+
+	events, err := client.ApsHistoryEvents(testStartTime.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("failed to read the APS history: %v", err)
+	}
+
+	var codes = []byte{}
+	for _, event := range events {
+		codes = append(codes, event.Code)
+	}
+	if len(events) != 2 || events[0].Code != APS_EVENT_TEMP_START || events[1].Code != APS_EVENT_TEMP_STOP {
+		t.Fatalf("expected a temp basal start & stop, got event codes %v", codes)
+	}
+	if events[0].Param1 != 150 || events[0].Param2 != 15 {
+		t.Errorf("expected a temp basal of 150%% for 15m, got %d%% for %dm", events[0].Param1, events[0].Param2)
+	}
+	if !events[0].Timestamp.Equal(testStartTime) || !events[1].Timestamp.Equal(testStartTime.Add(15*time.Minute)) {
+		t.Errorf("expected the temp basal to run from %v till %v, got %v till %v", testStartTime, testStartTime.Add(15*time.Minute), events[0].Timestamp, events[1].Timestamp)
+	}
+}
+
+// useTempWorkingDirectory runs the test in a temporary directory, as the simulator saves the state.json in the working
+// directory
+func useTempWorkingDirectory(t *testing.T) {
+	t.Helper()
+
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(workingDirectory) })
+}
+
+// commandTest is a command to the pump & the exact data of its response, as AAPS parses it
+type commandTest struct {
+	name     string
+	code     byte
+	request  []byte
+	expected []byte
+}
+
+// runCommandTests sends the commands in order, so a command can check the result of the ones before it
+func runCommandTests(t *testing.T, client *Client, tests []commandTest) {
+	t.Helper()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response, err = client.Command(test.code, test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(response, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, response)
+			}
+		})
+	}
+}
@@ -90,3 +90,14 @@ const (
 	OPCODE_ETC__SET_HISTORY_SAVE                           byte = 0xe0
 	OPCODE_ETC__KEEP_CONNECTION                            byte = 0xff
 )
+
+// Error codes, send back as the first byte of the response when a command is rejected
+const (
+	ERROR_CODE_NONE                    byte = 0x00
+	ERROR_CODE_PUMP_SUSPENDED          byte = 0x01
+	ERROR_CODE_BOLUS_TIMEOUT           byte = 0x04 // Another bolus is still running
+	ERROR_CODE_MAX_BOLUS_VIOLATION     byte = 0x10
+	ERROR_CODE_COMMAND                 byte = 0x20 // Invalid command parameters
+	ERROR_CODE_SPEED                   byte = 0x40
+	ERROR_CODE_INSULIN_LIMIT_VIOLATION byte = 0x80 // Max basal or max daily total
+)
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// A cartridge holds at most 300U
+	RESERVOIR_CAPACITY float32 = 300
+
+	// Default amount used to prime the tube after a refill
+	PRIME_TUBE_AMOUNT float32 = 10
+
+	// Param8 of a prime history item, to tell a tube prime from a cannula prime
+	PRIME_TYPE_TUBE    byte = 'T'
+	PRIME_TYPE_CANNULA byte = 'C'
+)
+
+// refill replaces the cartridge with a new one holding the amount. The pump blocks delivery till the tube & cannula
+// have been primed
+func (c *CommandCenter) refill(amount float32) error {
+	if amount <= 0 || amount > RESERVOIR_CAPACITY {
+		return fmt.Errorf("refill amount %vU is not within 0-%vU", amount, RESERVOIR_CAPACITY)
+	}
+
+	// Deliver the basal up till now from the old cartridge
+	c.updateBasalDelivery()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Refilling reservoir with " + fmt.Sprint(amount) + "U")
+	c.state.ReservoirLevel = amount
+	c.state.IsPrimeRequired = true
+	c.state.History = append(c.state.History, HistoryItem{
+		Timestamp: c.clock.Now(),
+		Code:      HISTORY_REFILL,
+		Value:     uint16(amount * 100),
+	})
+
+	if c.state.ActiveAlarm == ALARM_CODE_EMPTY_RESERVOIR {
+		c.clearAlarm()
+	}
+	c.state.Save()
+
+	return nil
+}
+
+// prime pushes the amount through the tube or the cannula. Priming the cannula finishes the cartridge change
+func (c *CommandCenter) prime(primeType byte, amount float32) error {
+	if amount <= 0 || amount > c.state.ReservoirLevel {
+		return fmt.Errorf("prime amount %vU is not within 0-%vU", amount, c.state.ReservoirLevel)
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Priming " + fmt.Sprint(amount) + "U (" + string(primeType) + ")")
+	var primed = c.takeFromReservoir(amount)
+	c.state.History = append(c.state.History, HistoryItem{
+		Timestamp: c.clock.Now(),
+		Code:      HISTORY_PRIME,
+		Param8:    primeType,
+		Value:     uint16(primed * 100),
+	})
+
+	if primeType == PRIME_TYPE_CANNULA {
+		c.state.IsPrimeRequired = false
+	}
+	c.state.Save()
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRefillAndPrime(t *testing.T) {
+	var state = NewState()
+	state.PumpType = PUMP_TYPE_DANA_RS_V3
+	state.BasalProfiles[state.ActiveBasalProfile] = make([]float32, BASAL_SLOTS_PER_PROFILE)
+
+	var simulator, client, _ = startLoopbackWithState(t, state)
+
+	// The initial screen of the DanaRS-v3, with the reservoir level at bytes 5-6. The error state of a missing prime is
+	// only sent by the Dana-I
+	var initialScreen = func(reservoirLevel []byte) []byte {
+		return []byte{0x00, 0x00, 0x00, 0xa8, 0x61, reservoirLevel[0], reservoirLevel[1], 0x00, 0x00, 0x64, 0x64, 0x00, 0x00, 0x00, 0x00}
+	}
+
+	for _, amount := range []float32{0, RESERVOIR_CAPACITY + 1} {
+		if err := simulator.Refill(amount); err == nil {
+			t.Errorf("expected a refill of %vU to be rejected", amount)
+		}
+	}
+	if err := simulator.Refill(200); err != nil {
+		t.Fatal(err)
+	}
+
+	runCommandTests(t, client, []commandTest{
+		{"refilled", OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, []byte{}, initialScreen([]byte{0x20, 0x4e})},
+		{"bolus before priming", OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{0x64, 0x00, 0x00}, []byte{ERROR_CODE_PUMP_SUSPENDED}},
+	})
+
+	if err := simulator.PrimeTube(250); err == nil {
+		t.Error("expected a prime of more than the reservoir level to be rejected")
+	}
+	if err := simulator.PrimeTube(PRIME_TUBE_AMOUNT); err != nil {
+		t.Fatal(err)
+	}
+
+	runCommandTests(t, client, []commandTest{
+		{"tube primed", OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, []byte{}, initialScreen([]byte{0x38, 0x4a})},
+		{"bolus before priming the cannula", OPCODE_BOLUS__SET_STEP_BOLUS_START, []byte{0x64, 0x00, 0x00}, []byte{ERROR_CODE_PUMP_SUSPENDED}},
+	})
+
+	// The cannula volume of 0.01U
+	if err := simulator.PrimeCannula(); err != nil {
+		t.Fatal(err)
+	}
+
+	runCommandTests(t, client, []commandTest{
+		{"cannula primed", OPCODE_REVIEW__INITIAL_SCREEN_INFORMATION, []byte{}, initialScreen([]byte{0x37, 0x4a})},
+	})
+
+	// The refill & primes in the APS history events, with the amounts in 0.01U
+	if err := client.send(TYPE_COMMAND, OPCODE__APS_HISTORY_EVENTS, []byte{26, 3, 14, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range [][]byte{
+		{APS_EVENT_REFILL, 26, 3, 14, 12, 0, 0, 0x4e, 0x20, 0x00, 0x00},
+		{APS_EVENT_PRIME, 26, 3, 14, 12, 0, 0, 0x03, 0xe8, 0x00, 0x00},
+		{APS_EVENT_PRIME_CANNULA, 26, 3, 14, 12, 0, 0, 0x00, 0x01, 0x00, 0x00},
+		{APS_EVENT_DONE, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		var data, err = client.WaitForNotification(OPCODE__APS_HISTORY_EVENTS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("event %d: expected %v, got %v", i, expected, data)
+		}
+	}
+
+	// The history records, with the prime type in param 8
+	if err := client.SetHistoryUploadMode(true); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name     string
+		code     byte
+		expected [][]byte
+	}{
+		{"refill", OPCODE_REVIEW__REFILL, [][]byte{
+			{HISTORY_REFILL, 26, 3, 14, 12, 0, 0, 0x00, 0x00, 0x4e, 0x20},
+			{0x00, 0x01, 0x00},
+		}},
+		{"prime", OPCODE_REVIEW__PRIME, [][]byte{
+			{HISTORY_PRIME, 26, 3, 14, 12, 0, 0, 0x00, PRIME_TYPE_TUBE, 0x03, 0xe8},
+			{HISTORY_PRIME, 26, 3, 14, 12, 0, 0, 0x00, PRIME_TYPE_CANNULA, 0x00, 0x01},
+			{0x00, 0x02, 0x00},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := client.send(TYPE_COMMAND, test.code, []byte{26, 3, 14, 0, 0, 0}); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, expected := range test.expected {
+				var packet, ok = client.responses.pop(client.Timeout)
+				if !ok {
+					t.Fatalf("record %d: timeout", i)
+				}
+				if !bytes.Equal(packet[2:], expected) {
+					t.Errorf("record %d: expected %v, got %v", i, expected, packet[2:])
+				}
+			}
+		})
+	}
+}
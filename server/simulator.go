@@ -4,12 +4,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"os"
-	"os/exec"
 	"slices"
 	"time"
-
-	"tinygo.org/x/bluetooth"
 )
 
 const (
@@ -28,85 +24,62 @@ type Simulator struct {
 	readBuffer    []byte
 
 	shouldDoSecondDecryption bool
-
-	writeCharacteristic bluetooth.Characteristic
-	readCharacteristic  bluetooth.Characteristic
 }
 
-func NewSimulator() Simulator {
-	var state = GetDefaultState()
-	var encryption = DanaEncryption{
-		state:         &state,
-		randomSyncKey: 0,
+// NewSimulator runs the pump stored in the state.json, generating a fresh pump if there is none yet
+func NewSimulator() (Simulator, error) {
+	state, err := GetDefaultState()
+	if err != nil {
+		return Simulator{}, err
 	}
 
+	return NewSimulatorWithState(state), nil
+}
+
+func NewSimulatorWithState(state SimulatorState) Simulator {
+	var encryption = NewDanaEncryption(&state)
+
 	var commandCenter = CommandCenter{
 		state:      &state,
-		encryption: &encryption,
+		encryption: encryption,
+		clock:      NewRealClock(),
 	}
 
 	return Simulator{
 		State:         &state,
-		encryption:    &encryption,
+		encryption:    encryption,
 		commandCenter: &commandCenter,
 	}
 }
 
+// SetClock replaces the real time of the pump, for example by an accelerated or fixed clock. Needs to be called before
+// the simulator is started
+func (s *Simulator) SetClock(clock Clock) {
+	s.commandCenter.clock = clock
+}
+
+// StartBluetooth runs the simulator as a real BLE peripheral
 func (s *Simulator) StartBluetooth() {
-	setDeviceName(s.State.Name)
-
-	var adapter = bluetooth.DefaultAdapter
-	// TinyGo bluetooth (linux) doesnt support connection handler
-	// adapter.SetConnectHandler(func(device bluetooth.Device, connected bool) {
-	// 	if connected && s.hasOpenConnection {
-	// 		fmt.Println("ERROR: Rejecting connection from " + device.Address.String() + ", Already has an open connection")
-	// 	} else if connected {
-	// 		s.hasOpenConnection = true
-	// 		s.isConnectionSecure = false
-	// 		encryption.ResetRandomSyncKey()
-	// 		s.readBuffer = []byte{}
-	// 		fmt.Println("INFO: Device connected: " + device.Address.String())
-	// 	} else {
-	// 		s.hasOpenConnection = false
-	// 		fmt.Println("INFO: Device disconnected: " + device.Address.String())
-	// 	}
-	// })
-
-	must("enable BLE stack", adapter.Enable())
-
-	// Define the peripheral device info.
-	adv := adapter.DefaultAdvertisement()
-	must("config adv", adv.Configure(bluetooth.AdvertisementOptions{
-		LocalName:    s.State.Name,
-		ServiceUUIDs: []bluetooth.UUID{},
-	}))
-
-	// Start advertising
-	must("start adv", adv.Start())
-	fmt.Println("Adversing with name: " + s.State.Name)
-
-	must("add service", adapter.AddService(&bluetooth.Service{
-		UUID: bluetooth.New16BitUUID(0xFFF0),
-		Characteristics: []bluetooth.CharacteristicConfig{
-			{
-				Handle: &s.writeCharacteristic,
-				UUID:   bluetooth.New16BitUUID(0xFFF1),
-				Value:  []byte{},
-				Flags:  bluetooth.CharacteristicNotifyPermission,
-			},
-			{
-				Handle:     &s.readCharacteristic,
-				UUID:       bluetooth.New16BitUUID(0xFFF2),
-				Value:      []byte{},
-				Flags:      bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
-				WriteEvent: s.handleMessage,
-			},
-		},
-	}))
-
-	s.commandCenter.writeCharacteristic = &s.writeCharacteristic
+	s.Start(NewBluetoothTransport())
+}
+
+func (s *Simulator) Start(transport Transport) {
+	s.commandCenter.transport = transport
+	must("start transport", transport.Start(s.State.Name, s.handleMessage))
+
 	s.State.Status = STATUS_RUNNING
 
+	// Continue delivering an extended bolus which was running before a restart
+	s.commandCenter.mutex.Lock()
+	if s.State.ExtendedBolusActiveTill != nil {
+		s.commandCenter.startExtendedBolusTicker()
+	}
+
+	// Catch up on the basal which has been delivered while the simulator was down
+	s.commandCenter.updateBasalDelivery()
+	s.commandCenter.startDeliveryTicker()
+	s.commandCenter.mutex.Unlock()
+
 	json, err := json.Marshal(s.State)
 	if err != nil {
 		fmt.Println(err)
@@ -116,7 +89,10 @@ func (s *Simulator) StartBluetooth() {
 	fmt.Println(time.Now().Format(time.RFC3339) + "INFO: Running pump with state: " + string(json))
 }
 
-func (s *Simulator) handleMessage(client bluetooth.Connection, offset int, value []byte) {
+func (s *Simulator) handleMessage(value []byte) {
+	s.commandCenter.mutex.Lock()
+	defer s.commandCenter.mutex.Unlock()
+
 	// If we receive a new message (for a non-danaRS-v1 pump) and the start byte isnt the normal start byte,
 	// we assume we need to do a second lvl decryption first.
 
@@ -128,7 +104,7 @@ func (s *Simulator) handleMessage(client bluetooth.Connection, offset int, value
 		s.shouldDoSecondDecryption = false
 	} else if len(s.readBuffer) == 0 {
 		// Only check if when the buffer is empty == new message
-		s.shouldDoSecondDecryption = value[0] != PACKET_START_BYTE
+		s.shouldDoSecondDecryption = s.isSecondLvlEncrypted(value)
 	}
 
 	if s.shouldDoSecondDecryption {
@@ -193,35 +169,72 @@ func (s *Simulator) handleMessage(client bluetooth.Connection, offset int, value
 	}
 }
 
-func setDeviceName(name string) {
-	// Force bluetooth name. This only works on linux
-	must("Write new machine-info file", os.WriteFile("machine-info", []byte("PRETTY_HOSTNAME="+name), 0666))
+// isSecondLvlEncrypted tells a second lvl encrypted message from the start of a new handshake. An encrypted message
+// can start with the start byte as well (for a Dana-I with the wrong Ble5Keys every message does), so once a phone is
+// connected such a message counts as encrypted when it decrypts into the start bytes
+func (s *Simulator) isSecondLvlEncrypted(value []byte) bool {
+	if value[0] != PACKET_START_BYTE {
+		return true
+	}
+	if !s.commandCenter.isPhoneConnected || len(value) < 2 {
+		return false
+	}
 
-	var cmd = exec.Command("/bin/sh", "-c", "sudo mv machine-info /etc/machine-info")
-	must("Write bluetooth name", cmd.Run())
+	var decrypted = s.encryption.PeekDecryptionSecondLvl(value)
+	return (decrypted[0] == PACKET_START_BYTE || decrypted[0] == ENCRYPTED_START_BYTE) &&
+		(decrypted[1] == PACKET_START_BYTE || decrypted[1] == ENCRYPTED_START_BYTE)
+}
 
-	// Randomize MAC-address to prevent device name caching issues, based on device name
-	// https://raspberrypi.stackexchange.com/a/124117
-	var newMac = ""
-	for i := 0; i < 6; i++ {
-		newMac += fmt.Sprintf("0x%x ", name[i])
+func must(action string, err error) {
+	if err != nil {
+		panic("failed to " + action + ": " + err.Error())
 	}
+}
 
-	fmt.Println("New BLE mac address (reversed): " + newMac)
-	cmd = exec.Command("/bin/sh", "-c", "sudo hcitool cmd 0x3f 0x001 "+newMac)
-	must("Randomize MAC-address", cmd.Run())
+// RaiseAlarm raises the alarm on the pump, as if the pump detected it itself
+func (s *Simulator) RaiseAlarm(code byte) {
+	s.commandCenter.mutex.Lock()
+	defer s.commandCenter.mutex.Unlock()
 
-	cmd = exec.Command("/bin/sh", "-c", "sudo hciconfig hci0 reset")
-	must("Reset bluetooth driver", cmd.Run())
+	s.commandCenter.raiseAlarm(code)
+}
 
-	cmd = exec.Command("/bin/sh", "-c", "sudo service bluetooth restart")
-	must("Restart bluetooth chip", cmd.Run())
+// ReplaceBattery puts a fresh battery in the pump
+func (s *Simulator) ReplaceBattery() {
+	s.commandCenter.mutex.Lock()
+	defer s.commandCenter.mutex.Unlock()
 
-	time.Sleep(5 * time.Second)
+	s.commandCenter.replaceBattery()
 }
 
-func must(action string, err error) {
-	if err != nil {
-		panic("failed to " + action + ": " + err.Error())
-	}
+// Refill replaces the cartridge with a new one holding the amount (in U)
+func (s *Simulator) Refill(amount float32) error {
+	s.commandCenter.mutex.Lock()
+	defer s.commandCenter.mutex.Unlock()
+
+	return s.commandCenter.refill(amount)
+}
+
+// PrimeTube pushes the amount (in U) through the tube after a refill
+func (s *Simulator) PrimeTube(amount float32) error {
+	s.commandCenter.mutex.Lock()
+	defer s.commandCenter.mutex.Unlock()
+
+	return s.commandCenter.prime(PRIME_TYPE_TUBE, amount)
+}
+
+// PrimeCannula fills the cannula with the CannulaVolume (in 0.01U), which makes the pump ready to deliver again
+func (s *Simulator) PrimeCannula() error {
+	s.commandCenter.mutex.Lock()
+	defer s.commandCenter.mutex.Unlock()
+
+	return s.commandCenter.prime(PRIME_TYPE_CANNULA, float32(s.State.CannulaVolume)/100)
+}
+
+// ClearAlarm confirms the active alarm, like the user would on the pump itself
+func (s *Simulator) ClearAlarm() {
+	s.commandCenter.mutex.Lock()
+	defer s.commandCenter.mutex.Unlock()
+
+	s.commandCenter.clearAlarm()
 }
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TcpTransport accepts raw BLE frames from a relay over TCP. As TCP is a stream,
+// every frame is prefixed with a single byte containing the length of the frame
+type TcpTransport struct {
+	address string
+
+	mutex      sync.Mutex
+	connection net.Conn
+}
+
+func NewTcpTransport(address string) *TcpTransport {
+	return &TcpTransport{address: address}
+}
+
+func (t *TcpTransport) Start(name string, onReceive func(data []byte)) error {
+	listener, err := net.Listen("tcp", t.address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Waiting for BLE relay on tcp " + listener.Addr().String())
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: failed to accept tcp connection: " + err.Error())
+				return
+			}
+
+			// Only a single phone can be connected to the pump
+			t.mutex.Lock()
+			if t.connection != nil {
+				t.connection.Close()
+			}
+			t.connection = connection
+			t.mutex.Unlock()
+
+			go t.read(connection, onReceive)
+		}
+	}()
+
+	return nil
+}
+
+func (t *TcpTransport) Write(data []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.connection == nil {
+		return errors.New("no relay connected")
+	}
+
+	var _, err = t.connection.Write(append([]byte{byte(len(data))}, data...))
+	return err
+}
+
+func (t *TcpTransport) read(connection net.Conn, onReceive func(data []byte)) {
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Relay connected: " + connection.RemoteAddr().String())
+	defer connection.Close()
+
+	var length = make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(connection, length); err != nil {
+			break
+		}
+
+		var frame = make([]byte, length[0])
+		if _, err := io.ReadFull(connection, frame); err != nil {
+			break
+		}
+
+		onReceive(frame)
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Relay disconnected: " + connection.RemoteAddr().String())
+
+	t.mutex.Lock()
+	if t.connection == connection {
+		t.connection = nil
+	}
+	t.mutex.Unlock()
+}
+
+// WebSocketTransport accepts raw BLE frames from a relay over a websocket, every binary message being a single frame.
+// The transport needs to be mounted on a http server
+type WebSocketTransport struct {
+	upgrader  websocket.Upgrader
+	onReceive func(data []byte)
+
+	mutex      sync.Mutex
+	connection *websocket.Conn
+}
+
+func NewWebSocketTransport() *WebSocketTransport {
+	return &WebSocketTransport{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+func (t *WebSocketTransport) Start(name string, onReceive func(data []byte)) error {
+	t.onReceive = onReceive
+	return nil
+}
+
+func (t *WebSocketTransport) Write(data []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.connection == nil {
+		return errors.New("no relay connected")
+	}
+
+	return t.connection.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (t *WebSocketTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if t.onReceive == nil {
+		http.Error(w, "simulator has not been started", http.StatusServiceUnavailable)
+		return
+	}
+
+	connection, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Println(time.Now().Format(time.RFC3339) + " ERROR: websocket upgrade failed: " + err.Error())
+		return
+	}
+	defer connection.Close()
+
+	// Only a single phone can be connected to the pump
+	t.mutex.Lock()
+	if t.connection != nil {
+		t.connection.Close()
+	}
+	t.connection = connection
+	t.mutex.Unlock()
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Relay connected: " + r.RemoteAddr)
+	for {
+		messageType, message, err := connection.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		if messageType != websocket.BinaryMessage {
+			fmt.Println(time.Now().Format(time.RFC3339) + " WARNING: Ignoring non-binary websocket message")
+			continue
+		}
+
+		t.onReceive(message)
+	}
+
+	fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Relay disconnected: " + r.RemoteAddr)
+
+	t.mutex.Lock()
+	if t.connection == connection {
+		t.connection = nil
+	}
+	t.mutex.Unlock()
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 )
@@ -14,6 +17,10 @@ const (
 	PUMP_TYPE_DANA_RS_V3 int = 1
 	PUMP_TYPE_DANA_RS_V1 int = 0
 
+	BASAL_PROFILE_COUNT     = 4
+	BASAL_SLOTS_PER_PROFILE = 48
+	BASAL_STEP              = 1 // 0.01U/hr, the only step AAPS accepts
+
 	STATUS_IDLE    int = 0
 	STATUS_RUNNING int = 1
 
@@ -34,9 +41,20 @@ const (
 	HISTORY_ALARM      = 0x0a
 	HISTORY_BASALHOUR  = 0x0b
 	HISTORY_TEMP_BASAL = 0x99
+	// Only known by the simulator, to report profile changes in the APS history events
+	HISTORY_PROFILE_CHANGE = 0x98
+
+	// Bolus type, stored in the upper nibble of Param8 of a bolus history item
+	BOLUS_TYPE_STEP          byte = 0x80
+	BOLUS_TYPE_DUAL_EXTENDED byte = 0x90
+	BOLUS_TYPE_DUAL_STEP     byte = 0xa0
+	BOLUS_TYPE_EXTENDED      byte = 0xc0
 )
 
 type SimulatorState struct {
+	// Version of the state.json layout, see stateMigration.go
+	SchemaVersion int
+
 	// Base information
 	Name     string
 	PumpType int
@@ -47,16 +65,48 @@ type SimulatorState struct {
 	PumpTimeZoneOffsetInSeconds int
 
 	// Technical settings
-	ReservoirLevel   float32
-	BatteryRemaining int
-	IsSuspended      bool
+	ReservoirLevel float32
+	IsSuspended    bool
+	// After a refill, the pump doesnt deliver till the cannula has been primed
+	IsPrimeRequired bool
+
+	// Battery, the charge drains over time, with every command & with every unit delivered. The pump only reports
+	// the charge in steps of 25%
+	BatteryRemaining       int
+	BatteryCharge          float32
+	BatteryDrainPerDay     float32
+	BatteryDrainPerCommand float32
+	BatteryDrainPerUnit    float32
+
+	// Alarms, the active alarm blocks all delivery till it is cleared
+	ActiveAlarm       byte
+	LastInteractionAt *time.Time
 
-	// Basal
-	BasalSchedule []float32
+	// Basal, the pump holds 4 profiles of 48 half-hour slots each
+	BasalProfiles      [][]float32
+	ActiveBasalProfile int
 
 	// temp basal
+	TempBasalStartedAt  *time.Time
 	TempBasalActiveTill *time.Time
 	TempBasalPercentage int
+	IsApsTempBasal      bool
+
+	// Extended bolus
+	ExtendedBolusStartedAt  *time.Time
+	ExtendedBolusActiveTill *time.Time
+	ExtendedBolusAmount     float32
+	ExtendedBolusDelivered  float32
+
+	// Dual bolus, the extended part is delivered as an extended bolus
+	IsDualBolus              bool
+	DualBolusImmediateAmount float32
+
+	// Delivery, kept up to date by the delivery engine
+	LastDeliveryAt      *time.Time
+	HourBasalDelivered  float32
+	TodayBasalDelivered float32
+	TodayBolusDelivered float32
 
 	// History
 	IsInHistoryUploadMode bool
@@ -74,11 +124,38 @@ type SimulatorState struct {
 	ShutdownInHours      int
 	CannulaVolume        int
 	RefillAmount         int
-	TargetBg             int
+	TargetBg             float32 // In mg/dL, like the correction factors
+
+	// Bolus options
+	IsExtendedBolusEnabled       bool
+	BolusCalculationOption       int
+	BolusStep                    float32
+	IsMissedBolusReminderEnabled bool
+	MissedBolusWindows           []MissedBolusWindow
 
-	// Pump limits
-	MaxBasal int
-	MaxBolus int
+	// Bolus calculator, the carb ratios (in g/U) & correction factors (in mg/dL/U) of the 4 blocks of the day & of
+	// every hour. The correction factors are reported in the Units of the pump
+	CarbRatios              []float32
+	CorrectionFactors       []float32
+	HourlyCarbRatios        []float32
+	HourlyCorrectionFactors []float32
+
+	// Duration of insulin action, used to calculate the insulin on board
+	InsulinDurationInHours float32
+
+	// Pump limits, in U/hr for the basal & U for the others
+	MaxBasal      int
+	MaxBolus      float32
+	MaxDailyTotal int
+
+	// User password, used by the DanaRS-v1 to secure the connection
+	Password int
+
+	// Pairing keys, generated on first start. Can be overridden in the state.json (as hex) to simulate a different pump
+	Ble5Keys          HexBytes // Dana-I, 6 ascii digits
+	PairingKeys       HexBytes // DanaRS-v3
+	RandomPairingKeys HexBytes // DanaRS-v3
+	PassKey           HexBytes // DanaRS-v1, empty until paired
 }
 
 func (s *SimulatorState) Save() {
@@ -88,35 +165,74 @@ func (s *SimulatorState) Save() {
 		return
 	}
 
-	if err := os.WriteFile("state.json", []byte(json), 0666); err != nil {
+	if err := os.WriteFile(STATE_FILE, []byte(json), 0666); err != nil {
 		fmt.Println(err)
 	}
 }
 
+// HexBytes is stored as a hex string in the state.json, so keys are readable and easy to override
+type HexBytes []byte
+
+func (h HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *HexBytes) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return err
+	}
+
+	*h = decoded
+	return nil
+}
+
 type HistoryItem struct {
-	timestamp time.Time
-	code      byte
-	param7    byte
-	param8    byte
-	value     uint16
+	Timestamp time.Time
+	Code      byte
+	Param7    byte
+	Param8    byte
+	Value     uint16
 }
 
-func GetDefaultState() SimulatorState {
-	if content, err := os.ReadFile("state.json"); err == nil {
-		var payload SimulatorState
-		err = json.Unmarshal(content, &payload)
-		if err == nil {
-			return payload
-		}
+// GetDefaultState loads the state.json, migrating it to the current schema version. A fresh pump is only generated
+// when there is no state.json yet, a state.json which cannot be read is reported instead of being overwritten
+func GetDefaultState() (SimulatorState, error) {
+	content, err := os.ReadFile(STATE_FILE)
+	if errors.Is(err, os.ErrNotExist) {
+		var state = NewState()
+		state.Save()
+
+		return state, nil
+	}
+	if err != nil {
+		return SimulatorState{}, fmt.Errorf("failed to read %s: %w", STATE_FILE, err)
 	}
 
-	// For every 30 min add 1U/hr as schedule
-	basalSchedule := make([]float32, 48)
-	for i := range basalSchedule {
-		basalSchedule[i] = 1
+	state, hasChanged, err := parseState(content)
+	if err != nil {
+		return SimulatorState{}, fmt.Errorf("corrupt %s: %w", STATE_FILE, err)
+	}
+
+	var keysChanged = state.EnsurePairingKeys()
+	var profilesChanged = state.EnsureBasalProfiles()
+	if hasChanged || keysChanged || profilesChanged {
+		state.Save()
 	}
 
+	return state, nil
+}
+
+// NewState generates a fresh pump, without touching the state.json
+func NewState() SimulatorState {
 	var state = SimulatorState{
+		SchemaVersion: STATE_SCHEMA_VERSION,
+
 		Status:   STATUS_IDLE,
 		PumpType: PUMP_TYPE_DANA_I,
 		Name:     randomName(),
@@ -124,10 +240,16 @@ func GetDefaultState() SimulatorState {
 		PumpTimeSkewInSeconds:       0,
 		PumpTimeZoneOffsetInSeconds: timeZoneOffset,
 
-		ReservoirLevel:      300,
-		BatteryRemaining:    100, // Only 100, 75, 50 & 25 are valid values
-		IsSuspended:         false,
-		BasalSchedule:       basalSchedule,
+		ReservoirLevel: 300,
+		IsSuspended:    false,
+
+		BatteryRemaining:       100, // Only 100, 75, 50, 25 & 0 are valid values
+		BatteryCharge:          100,
+		BatteryDrainPerDay:     BATTERY_DRAIN_PER_DAY,
+		BatteryDrainPerCommand: BATTERY_DRAIN_PER_COMMAND,
+		BatteryDrainPerUnit:    BATTERY_DRAIN_PER_UNIT,
+
+		ActiveBasalProfile:  0,
 		TempBasalActiveTill: nil,
 		TempBasalPercentage: 100,
 
@@ -142,16 +264,98 @@ func GetDefaultState() SimulatorState {
 		CannulaVolume:        1,
 		ShutdownInHours:      0,
 		RefillAmount:         300,
-		TargetBg:             5,
+		TargetBg:             DEFAULT_TARGET_BG,
 
-		MaxBasal: 3,
-		MaxBolus: 10,
+		InsulinDurationInHours: 5,
+
+		IsExtendedBolusEnabled: true,
+		BolusStep:              DEFAULT_BOLUS_STEP,
+		MissedBolusWindows:     make([]MissedBolusWindow, MISSED_BOLUS_WINDOW_COUNT),
+
+		CarbRatios:              repeatValue(DEFAULT_CARB_RATIO, CIR_CF_BLOCK_COUNT),
+		CorrectionFactors:       repeatValue(DEFAULT_CORRECTION_FACTOR, CIR_CF_BLOCK_COUNT),
+		HourlyCarbRatios:        repeatValue(DEFAULT_CARB_RATIO, CIR_CF_HOUR_COUNT),
+		HourlyCorrectionFactors: repeatValue(DEFAULT_CORRECTION_FACTOR, CIR_CF_HOUR_COUNT),
+
+		MaxBasal:      3,
+		MaxBolus:      10,
+		MaxDailyTotal: 250,
+
+		Password: 0,
 	}
-	state.Save()
+	state.EnsurePairingKeys()
+	state.EnsureBasalProfiles()
 
 	return state
 }
 
+// EnsureBasalProfiles fills every missing or invalid basal profile with 1U/hr. Returns true if any profile has been (re)generated
+func (s *SimulatorState) EnsureBasalProfiles() bool {
+	var hasChanged = false
+
+	if len(s.BasalProfiles) != BASAL_PROFILE_COUNT {
+		var profiles = make([][]float32, BASAL_PROFILE_COUNT)
+		copy(profiles, s.BasalProfiles)
+		s.BasalProfiles = profiles
+		hasChanged = true
+	}
+
+	for i, profile := range s.BasalProfiles {
+		if len(profile) == BASAL_SLOTS_PER_PROFILE {
+			continue
+		}
+
+		// For every 30 min add 1U/hr as schedule
+		s.BasalProfiles[i] = make([]float32, BASAL_SLOTS_PER_PROFILE)
+		for slot := range s.BasalProfiles[i] {
+			s.BasalProfiles[i][slot] = 1
+		}
+		hasChanged = true
+	}
+
+	if s.ActiveBasalProfile < 0 || s.ActiveBasalProfile >= BASAL_PROFILE_COUNT {
+		s.ActiveBasalProfile = 0
+		hasChanged = true
+	}
+
+	return hasChanged
+}
+
+// ActiveBasalSchedule returns the 48 half-hour slots of the active basal profile
+func (s *SimulatorState) ActiveBasalSchedule() []float32 {
+	return s.BasalProfiles[s.ActiveBasalProfile]
+}
+
+// EnsurePairingKeys generates every missing or invalid pairing key. Returns true if any key has been (re)generated
+func (s *SimulatorState) EnsurePairingKeys() bool {
+	var hasChanged = false
+
+	if len(s.Ble5Keys) != 6 || slices.ContainsFunc(s.Ble5Keys, func(b byte) bool { return b < 0x30 || b > 0x39 }) {
+		s.Ble5Keys = make([]byte, 6)
+		for i := range s.Ble5Keys {
+			s.Ble5Keys[i] = 0x30 + randomInt(0, 10)
+		}
+		hasChanged = true
+	}
+
+	if len(s.PairingKeys) != 6 {
+		s.PairingKeys = randomBytes(6)
+		hasChanged = true
+	}
+
+	if len(s.RandomPairingKeys) != 3 {
+		s.RandomPairingKeys = randomBytes(3)
+		hasChanged = true
+	}
+
+	if len(s.PassKey) != 0 && len(s.PassKey) != 2 {
+		s.PassKey = HexBytes{}
+		hasChanged = true
+	}
+
+	return hasChanged
+}
+
 func randomName() string {
 	var characters = "ABCDEFGHIJKLMNOPQRSTUVXYZ"
 	var length = len(characters)
@@ -172,3 +376,12 @@ func randomName() string {
 func randomInt(min, max int) uint8 {
 	return uint8(min + rand.Intn(max-min))
 }
+
+func randomBytes(length int) []byte {
+	var bytes = make([]byte, length)
+	for i := range bytes {
+		bytes[i] = randomInt(0, 256)
+	}
+
+	return bytes
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	STATE_FILE = "state.json"
+
+	// Bump the version & add a migration to stateMigrations whenever a change to the SimulatorState would break the
+	// loading of an existing state.json (renaming, moving or changing the meaning of a field)
+	STATE_SCHEMA_VERSION = 7
+)
+
+// stateMigrations migrates the raw state.json content from version i to version i+1. Migrations work on the raw
+// json, as the fields they migrate from are no longer in the SimulatorState
+var stateMigrations = []func(state map[string]any) error{
+	migrateStateToV1,
+	migrateStateToV2,
+	migrateStateToV3,
+	migrateStateToV4,
+	migrateStateToV5,
+	migrateStateToV6,
+	migrateStateToV7,
+}
+
+// parseState parses & migrates the content of a state.json. Returns true if the state has been migrated
+func parseState(content []byte) (SimulatorState, bool, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return SimulatorState{}, false, err
+	}
+
+	var version = 0
+	if value, ok := raw["SchemaVersion"]; ok {
+		number, ok := value.(float64)
+		if !ok {
+			return SimulatorState{}, false, fmt.Errorf("invalid schema version: %v", value)
+		}
+		version = int(number)
+	}
+
+	if version < 0 || version > STATE_SCHEMA_VERSION {
+		return SimulatorState{}, false, fmt.Errorf("unsupported schema version %d, the simulator supports up to version %d", version, STATE_SCHEMA_VERSION)
+	}
+
+	for i := version; i < STATE_SCHEMA_VERSION; i++ {
+		if err := stateMigrations[i](raw); err != nil {
+			return SimulatorState{}, false, fmt.Errorf("failed to migrate from schema version %d: %w", i, err)
+		}
+
+		fmt.Println(time.Now().Format(time.RFC3339) + " INFO: Migrated " + STATE_FILE + " to schema version " + fmt.Sprint(i+1))
+	}
+	raw["SchemaVersion"] = STATE_SCHEMA_VERSION
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return SimulatorState{}, false, err
+	}
+
+	var state SimulatorState
+	if err := json.Unmarshal(migrated, &state); err != nil {
+		return SimulatorState{}, false, err
+	}
+
+	return state, version != STATE_SCHEMA_VERSION, nil
+}
+
+// migrateStateToV1 migrates the unversioned state.json
+func migrateStateToV1(state map[string]any) error {
+	// The single basal schedule became the first of the basal profiles
+	if schedule, ok := state["BasalSchedule"]; ok {
+		if _, hasProfiles := state["BasalProfiles"]; !hasProfiles && schedule != nil {
+			state["BasalProfiles"] = []any{schedule}
+		}
+		delete(state, "BasalSchedule")
+	}
+
+	// History items used to be stored as empty objects, which are of no use
+	if history, ok := state["History"].([]any); ok {
+		var items = []any{}
+		for _, item := range history {
+			if fields, ok := item.(map[string]any); ok && fields["Timestamp"] != nil {
+				items = append(items, item)
+			}
+		}
+		state["History"] = items
+	}
+
+	return nil
+}
+
+// migrateStateToV2 adds the max daily total, which used to be fixed at 250U
+func migrateStateToV2(state map[string]any) error {
+	if _, ok := state["MaxDailyTotal"]; !ok {
+		state["MaxDailyTotal"] = 250
+	}
+
+	return nil
+}
+
+// migrateStateToV3 adds the battery model, starting from the fixed battery level
+func migrateStateToV3(state map[string]any) error {
+	if _, ok := state["BatteryCharge"]; !ok {
+		var charge any = 100
+		if remaining, ok := state["BatteryRemaining"]; ok {
+			charge = remaining
+		}
+		state["BatteryCharge"] = charge
+	}
+
+	var defaults = map[string]float32{
+		"BatteryDrainPerDay":     BATTERY_DRAIN_PER_DAY,
+		"BatteryDrainPerCommand": BATTERY_DRAIN_PER_COMMAND,
+		"BatteryDrainPerUnit":    BATTERY_DRAIN_PER_UNIT,
+	}
+	for key, value := range defaults {
+		if _, ok := state[key]; !ok {
+			state[key] = value
+		}
+	}
+
+	return nil
+}
+
+// migrateStateToV4 adds the duration of insulin action, used for the insulin on board
+func migrateStateToV4(state map[string]any) error {
+	if _, ok := state["InsulinDurationInHours"]; !ok {
+		state["InsulinDurationInHours"] = 5
+	}
+
+	return nil
+}
+
+// migrateStateToV5 adds the bolus options. Extended boluses were always allowed, so they stay enabled
+func migrateStateToV5(state map[string]any) error {
+	var defaults = map[string]any{
+		"IsExtendedBolusEnabled": true,
+		"BolusStep":              DEFAULT_BOLUS_STEP,
+		"MissedBolusWindows":     make([]MissedBolusWindow, MISSED_BOLUS_WINDOW_COUNT),
+	}
+	for key, value := range defaults {
+		if _, ok := state[key]; !ok {
+			state[key] = value
+		}
+	}
+
+	return nil
+}
+
+// migrateStateToV6 adds the carb ratios & correction factors of the bolus calculator. Lists of the wrong length are
+// replaced as well, the pump always works on all blocks or hours at once
+func migrateStateToV6(state map[string]any) error {
+	var defaults = map[string][]float32{
+		"CarbRatios":              repeatValue(DEFAULT_CARB_RATIO, CIR_CF_BLOCK_COUNT),
+		"CorrectionFactors":       repeatValue(DEFAULT_CORRECTION_FACTOR, CIR_CF_BLOCK_COUNT),
+		"HourlyCarbRatios":        repeatValue(DEFAULT_CARB_RATIO, CIR_CF_HOUR_COUNT),
+		"HourlyCorrectionFactors": repeatValue(DEFAULT_CORRECTION_FACTOR, CIR_CF_HOUR_COUNT),
+	}
+	for key, value := range defaults {
+		if values, ok := state[key].([]any); !ok || len(values) != len(value) {
+			state[key] = value
+		}
+	}
+
+	return nil
+}
+
+// migrateStateToV7 moves the target glucose to mg/dL. It used to be stored as received, which is mmol/L times 100 when
+// set by a phone in mmol/L, but the default was a plain 5 mmol/L whatever the units. No target is below 20 mg/dL, so
+// those values are in mmol/L
+func migrateStateToV7(state map[string]any) error {
+	targetBg, ok := state["TargetBg"].(float64)
+	if !ok || targetBg <= 0 {
+		state["TargetBg"] = DEFAULT_TARGET_BG
+		return nil
+	}
+
+	var units, _ = state["Units"].(float64)
+	switch {
+	case targetBg < 20:
+		state["TargetBg"] = targetBg * MMOL_TO_MGDL
+	case int(units) == UNITS_MMOL:
+		state["TargetBg"] = targetBg / 100 * MMOL_TO_MGDL
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateStateToV1(t *testing.T) {
+	// An unversioned state.json, with the single basal schedule & an empty history item
+	var content = `{
+		"Name": "AAA00000AA",
+		"BasalSchedule": [` + strings.Repeat("0.5, ", 24) + strings.Repeat("1.25, ", 23) + `1.25],
+		"History": [
+			{},
+			{"Timestamp": "2026-03-14T12:00:00Z", "Code": 2, "Param7": 0, "Param8": 0, "Value": 100}
+		]
+	}`
+
+	var state, hasChanged, err = parseState([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasChanged {
+		t.Error("expected the state to be migrated")
+	}
+
+	var schedule = make([]float32, BASAL_SLOTS_PER_PROFILE)
+	for slot := range schedule {
+		schedule[slot] = 0.5
+		if slot >= 24 {
+			schedule[slot] = 1.25
+		}
+	}
+	if len(state.BasalProfiles) != 1 || !slices.Equal(state.BasalProfiles[0], schedule) {
+		t.Errorf("expected the basal schedule to become the first profile, got %v", state.BasalProfiles)
+	}
+
+	var expected = HistoryItem{Timestamp: time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC), Code: HISTORYBOLUS, Value: 100}
+	if len(state.History) != 1 || !state.History[0].Timestamp.Equal(expected.Timestamp) || state.History[0].Code != expected.Code || state.History[0].Value != expected.Value {
+		t.Errorf("expected the empty history item to be dropped, got %+v", state.History)
+	}
+}
+
+func TestMigrateTargetBg(t *testing.T) {
+	var tests = []struct {
+		name     string
+		content  string
+		expected float32
+	}{
+		{"default in mg/dL", `{"SchemaVersion": 6, "Units": 0, "TargetBg": 5}`, 90.09},
+		{"default in mmol/L", `{"SchemaVersion": 6, "Units": 1, "TargetBg": 5}`, 90.09},
+		{"set in mg/dL", `{"SchemaVersion": 6, "Units": 0, "TargetBg": 110}`, 110},
+		{"set in mmol/L", `{"SchemaVersion": 6, "Units": 1, "TargetBg": 550}`, 99.1},
+		{"missing", `{"SchemaVersion": 6, "Units": 1}`, DEFAULT_TARGET_BG},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state, hasChanged, err = parseState([]byte(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !hasChanged || state.SchemaVersion != STATE_SCHEMA_VERSION {
+				t.Errorf("expected a migration to version %d, got version %d", STATE_SCHEMA_VERSION, state.SchemaVersion)
+			}
+			if math.Abs(float64(state.TargetBg-test.expected)) > 0.01 {
+				t.Errorf("expected a target of %v mg/dL, got %v mg/dL", test.expected, state.TargetBg)
+			}
+		})
+	}
+}
+
+func TestMigrateStateToV2(t *testing.T) {
+	var tests = []struct {
+		name     string
+		content  string
+		expected int
+	}{
+		// The max daily total used to be fixed
+		{"missing", `{"SchemaVersion": 1, "MaxBolus": 10}`, 250},
+		{"set", `{"SchemaVersion": 1, "MaxBolus": 10, "MaxDailyTotal": 80}`, 80},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state, hasChanged, err = parseState([]byte(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !hasChanged {
+				t.Error("expected the state to be migrated")
+			}
+			if state.MaxDailyTotal != test.expected {
+				t.Errorf("expected a max daily total of %vU, got %vU", test.expected, state.MaxDailyTotal)
+			}
+		})
+	}
+}
+
+func TestMigrateStateToV3(t *testing.T) {
+	var tests = []struct {
+		name          string
+		content       string
+		expected      float32
+		expectedDrain float32
+	}{
+		// The charge starts from the fixed battery level
+		{"fixed battery level", `{"SchemaVersion": 2, "BatteryRemaining": 50}`, 50, BATTERY_DRAIN_PER_DAY},
+		{"missing", `{"SchemaVersion": 2}`, 100, BATTERY_DRAIN_PER_DAY},
+		{"set", `{"SchemaVersion": 2, "BatteryRemaining": 50, "BatteryCharge": 42.5, "BatteryDrainPerDay": 0}`, 42.5, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state, hasChanged, err = parseState([]byte(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !hasChanged {
+				t.Error("expected the state to be migrated")
+			}
+			if state.BatteryCharge != test.expected {
+				t.Errorf("expected a charge of %v%%, got %v%%", test.expected, state.BatteryCharge)
+			}
+			if state.BatteryDrainPerDay != test.expectedDrain || state.BatteryDrainPerCommand != BATTERY_DRAIN_PER_COMMAND || state.BatteryDrainPerUnit != BATTERY_DRAIN_PER_UNIT {
+				t.Errorf("expected a drain of %v%% per day, %v%% per command & %v%% per unit, got %v%%, %v%% & %v%%", test.expectedDrain, BATTERY_DRAIN_PER_COMMAND, BATTERY_DRAIN_PER_UNIT, state.BatteryDrainPerDay, state.BatteryDrainPerCommand, state.BatteryDrainPerUnit)
+			}
+		})
+	}
+}
+
+func TestMigrateStateToV4(t *testing.T) {
+	var tests = []struct {
+		name     string
+		content  string
+		expected float32
+	}{
+		{"missing", `{"SchemaVersion": 3}`, 5},
+		{"set", `{"SchemaVersion": 3, "InsulinDurationInHours": 3.5}`, 3.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state, hasChanged, err = parseState([]byte(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !hasChanged {
+				t.Error("expected the state to be migrated")
+			}
+			if state.InsulinDurationInHours != test.expected {
+				t.Errorf("expected an insulin duration of %vh, got %vh", test.expected, state.InsulinDurationInHours)
+			}
+		})
+	}
+}
+
+func TestMigrateStateToV5(t *testing.T) {
+	var tests = []struct {
+		name                   string
+		content                string
+		isExtendedBolusEnabled bool
+		bolusStep              float32
+	}{
+		{"missing", `{"SchemaVersion": 4}`, true, DEFAULT_BOLUS_STEP},
+		{"set", `{"SchemaVersion": 4, "IsExtendedBolusEnabled": false, "BolusStep": 0.1}`, false, 0.1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var state, hasChanged, err = parseState([]byte(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !hasChanged {
+				t.Error("expected the state to be migrated")
+			}
+			if state.IsExtendedBolusEnabled != test.isExtendedBolusEnabled {
+				t.Errorf("expected the extended bolus to be enabled: %v, got %v", test.isExtendedBolusEnabled, state.IsExtendedBolusEnabled)
+			}
+			if state.BolusStep != test.bolusStep {
+				t.Errorf("expected a bolus step of %vU, got %vU", test.bolusStep, state.BolusStep)
+			}
+			if len(state.MissedBolusWindows) != MISSED_BOLUS_WINDOW_COUNT {
+				t.Errorf("expected %d missed bolus windows, got %d", MISSED_BOLUS_WINDOW_COUNT, len(state.MissedBolusWindows))
+			}
+		})
+	}
+}
+
+func TestMigrateStateToV6(t *testing.T) {
+	// The carb ratios are kept, the correction factors of the wrong length are replaced & the hourly values are added
+	var content = `{"SchemaVersion": 5, "CarbRatios": [8, 12, 15, 20], "CorrectionFactors": [36, 54]}`
+
+	var state, hasChanged, err = parseState([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasChanged {
+		t.Error("expected the state to be migrated")
+	}
+
+	var expected = map[string][][]float32{
+		"carb ratios":               {state.CarbRatios, {8, 12, 15, 20}},
+		"correction factors":        {state.CorrectionFactors, repeatValue(DEFAULT_CORRECTION_FACTOR, CIR_CF_BLOCK_COUNT)},
+		"hourly carb ratios":        {state.HourlyCarbRatios, repeatValue(DEFAULT_CARB_RATIO, CIR_CF_HOUR_COUNT)},
+		"hourly correction factors": {state.HourlyCorrectionFactors, repeatValue(DEFAULT_CORRECTION_FACTOR, CIR_CF_HOUR_COUNT)},
+	}
+	for name, values := range expected {
+		if !slices.Equal(values[0], values[1]) {
+			t.Errorf("expected %s %v, got %v", name, values[1], values[0])
+		}
+	}
+}
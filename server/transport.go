@@ -0,0 +1,9 @@
+package server
+
+// Transport moves raw BLE frames between the simulator and a phone.
+// Start must call onReceive for every frame written by the phone, Write sends a single frame
+// (never more than 20 bytes) back to the phone.
+type Transport interface {
+	Start(name string, onReceive func(data []byte)) error
+	Write(data []byte) error
+}